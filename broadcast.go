@@ -0,0 +1,49 @@
+package pulse
+
+import (
+	"context"
+
+	"github.com/fromjyce/pulse/internal/transfer"
+)
+
+// MaxRecipients is the most receivers one broadcast can serve
+const MaxRecipients = transfer.MaxRecipients
+
+// RecipientResult is how a broadcast went for one receiver
+type RecipientResult = transfer.RecipientResult
+
+// Broadcast sends the same files to several receivers that all open the
+// session's download link. Each receiver has its own flow control, so a slow
+// phone does not hold up the others.
+type Broadcast struct {
+	session   Session
+	broadcast *transfer.Broadcast
+}
+
+// NewBroadcast takes the same options as NewClient. Progress is reported
+// through WithObserver, as RecipientEvents.
+func NewBroadcast(session Session, recipients int, opts ...Option) *Broadcast {
+	c := NewClient(session, opts...)
+	return &Broadcast{session: session, broadcast: transfer.NewBroadcast(c.relay, session.Token, session.Key, recipients, c.config)}
+}
+
+// Connect prepares the room on the relay. Call it before handing out the
+// link.
+func (b *Broadcast) Connect(ctx context.Context) error {
+	if err := b.session.checkKey(); err != nil {
+		return err
+	}
+	return b.broadcast.Connect(ctx)
+}
+
+// SendEntries sends a batch made with CollectEntries to each receiver once
+// it joins. There is one result per recipient, and the error says how many
+// did not get the batch.
+func (b *Broadcast) SendEntries(ctx context.Context, entries []Entry) ([]RecipientResult, error) {
+	return b.broadcast.SendBatch(ctx, entries)
+}
+
+// Close leaves the relay
+func (b *Broadcast) Close() error {
+	return b.broadcast.Close()
+}
@@ -0,0 +1,226 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/fromjyce/pulse/internal/transfer"
+)
+
+// Client sends to or receives from the peer of one session. A client takes
+// one role: the first Send or Receive decides which.
+type Client struct {
+	session  Session
+	relay    string
+	config   transfer.Config
+	progress func(index int, done, total int64)
+
+	sender   *transfer.Sender
+	receiver *transfer.Receiver
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithRelay uses another relay than DefaultRelay
+func WithRelay(url string) Option {
+	return func(c *Client) { c.relay = url }
+}
+
+// WithChunkSize sets the chunk size in bytes, 64KB by default
+func WithChunkSize(n int) Option {
+	return func(c *Client) { c.config.ChunkSize = n }
+}
+
+// WithTimeout bounds every wait for the peer, 5 minutes by default
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.config.Timeout = d }
+}
+
+// WithRetries sets how often connecting and reconnecting mid-transfer are
+// retried, 3 by default
+func WithRetries(n int) Option {
+	return func(c *Client) { c.config.Retries = n }
+}
+
+// WithCompression compresses chunks of compressible files when the
+// receiver supports it
+func WithCompression() Option {
+	return func(c *Client) { c.config.Compress = true }
+}
+
+// WithDelta only sends what changed in files the receiver already has
+func WithDelta() Option {
+	return func(c *Client) { c.config.Delta = true }
+}
+
+// WithLogger receives debug messages
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(c *Client) { c.config.Logf = logf }
+}
+
+// WithProgress is called as entries are transferred, with the index of the
+// entry in the batch. total is -1 for streams of unknown length.
+func WithProgress(fn func(index int, done, total int64)) Option {
+	return func(c *Client) { c.progress = fn }
+}
+
+// WithObserver receives the events of every transfer: phases, the start
+// and end of each entry, throughput samples, retries and errors
+func WithObserver(o Observer) Option {
+	return func(c *Client) { c.config.Observer = o }
+}
+
+// WithConflictPolicy decides what happens to received entries that already
+// exist, ConflictRename by default. ask is called under ConflictAsk.
+func WithConflictPolicy(policy ConflictPolicy, ask func(path string) ConflictPolicy) Option {
+	return func(c *Client) {
+		c.config.OnConflict = policy
+		c.config.Ask = ask
+	}
+}
+
+// WithPreserve keeps modification times, exact directory modes and
+// symlinks of received entries
+func WithPreserve() Option {
+	return func(c *Client) { c.config.Preserve = true }
+}
+
+// WithLimits refuses received files larger than maxSize and batches larger
+// than maxTotal bytes. Zero means no limit.
+func WithLimits(maxSize, maxTotal int64) Option {
+	return func(c *Client) {
+		c.config.MaxSize = maxSize
+		c.config.MaxTotal = maxTotal
+	}
+}
+
+// WithAccept is asked about the first entry of every incoming batch before
+// anything is written. Returning false fails Receive with ErrDeclined.
+func WithAccept(accept func(meta Metadata) bool) Option {
+	return func(c *Client) { c.config.Accept = accept }
+}
+
+// NewClient returns a client for session, using DefaultRelay unless opts
+// say otherwise. Nothing is connected until the first Send or Receive.
+func NewClient(session Session, opts ...Option) *Client {
+	c := &Client{session: session, relay: DefaultRelay}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// FileInfo describes the content given to Send
+type FileInfo struct {
+	Name    string // slash-separated path the receiver recreates
+	Size    int64  // -1 if unknown
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+var errRole = errors.New("client is already used for the other direction")
+
+// WaitForReceiver connects to the relay and blocks until the receiver has
+// joined. The send methods call it when needed.
+func (c *Client) WaitForReceiver(ctx context.Context) error {
+	if c.receiver != nil {
+		return errRole
+	}
+	if c.sender != nil {
+		return nil
+	}
+	if err := c.session.checkKey(); err != nil {
+		return err
+	}
+	sender := transfer.NewSender(c.relay, c.session.Token, c.session.Key, c.config)
+	if err := sender.Connect(ctx); err != nil {
+		return err
+	}
+	timeout := c.config.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	if err := sender.WaitForReceiver(ctx, timeout); err != nil {
+		sender.Close()
+		return err
+	}
+	c.sender = sender
+	return nil
+}
+
+// Send sends what r yields as one file. Content of known size that can
+// seek is resumed after reconnecting; anything else is sent as a stream,
+// verified with a checksum at the end.
+func (c *Client) Send(ctx context.Context, r io.Reader, info FileInfo) (Stats, error) {
+	if err := c.WaitForReceiver(ctx); err != nil {
+		return Stats{}, err
+	}
+	progressFn := c.fileProgress()
+	if rs, ok := r.(io.ReadSeeker); ok && info.Size >= 0 {
+		entry := Entry{RelPath: info.Name, Mode: info.Mode.Perm(), ModTime: info.ModTime, Size: info.Size}
+		return c.sender.SendReader(ctx, rs, entry, progressFn)
+	}
+	return c.sender.SendStream(ctx, r, info.Name, progressFn)
+}
+
+// SendEntries sends a batch made with CollectEntries. On error the stats
+// of the entries already delivered are returned.
+func (c *Client) SendEntries(ctx context.Context, entries []Entry) ([]Stats, error) {
+	if err := c.WaitForReceiver(ctx); err != nil {
+		return nil, err
+	}
+	return c.sender.SendBatch(ctx, entries, c.progress)
+}
+
+// SendText sends a short message that the receiver shows instead of saving
+func (c *Client) SendText(ctx context.Context, text string) (Stats, error) {
+	if err := c.WaitForReceiver(ctx); err != nil {
+		return Stats{}, err
+	}
+	return c.sender.SendText(ctx, text, c.fileProgress())
+}
+
+// Receive connects to the relay if needed and waits for the sender, then
+// hands what arrives to sink
+func (c *Client) Receive(ctx context.Context, sink Sink) ([]ReceivedFile, error) {
+	if c.sender != nil {
+		return nil, errRole
+	}
+	if c.receiver == nil {
+		if err := c.session.checkKey(); err != nil {
+			return nil, err
+		}
+		receiver := transfer.NewReceiverWithConfig(c.relay, c.session.Token, c.session.Key, c.config)
+		if err := receiver.Connect(ctx); err != nil {
+			return nil, err
+		}
+		c.receiver = receiver
+	}
+	return sink.receive(ctx, c.receiver, c.progress)
+}
+
+// Close leaves the relay
+func (c *Client) Close() error {
+	var err error
+	if c.sender != nil {
+		err = c.sender.Close()
+	}
+	if c.receiver != nil {
+		err = c.receiver.Close()
+	}
+	return err
+}
+
+func (c *Client) fileProgress() func(done, total int64) {
+	if c.progress == nil {
+		return nil
+	}
+	return func(done, total int64) { c.progress(0, done, total) }
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fromjyce/pulse"
+	"github.com/fromjyce/pulse/internal/codes"
+)
+
+// connectCode shows a short code and blocks until the receiver typed it
+// and joined. Both sides derive the key from the code with SPAKE2.
+func connectCode(opts options, extra ...pulse.Option) (*pulse.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	nameplate, err := codes.Allocate(ctx, opts.relay)
+	if err != nil {
+		return nil, err
+	}
+	code, err := codes.Generate(nameplate)
+	if err != nil {
+		return nil, err
+	}
+
+	command := "pulse receive --code " + code
+	if opts.relay != pulse.DefaultRelay {
+		command = fmt.Sprintf("pulse --relay %s receive --code %s", opts.relay, code)
+	}
+	emitJSON(codeEvent{Event: "code", Code: code, Relay: opts.relay})
+	say("  %sCode: %s\n\n  On the other side run:\n    %s\n\n", icon("🔑"), code, command)
+	say("  %sE2E Encrypted\n  %sWaiting for receiver...\n\n", icon("🔒"), icon("⏳"))
+
+	token, key, err := codes.Exchange(ctx, opts.relay, code, true)
+	if err != nil {
+		return nil, err
+	}
+	client := pulse.NewClient(pulse.Session{Token: token, Key: key}, opts.clientOptions(extra...)...)
+	if err := client.WaitForReceiver(context.Background()); err != nil {
+		return nil, err
+	}
+	say("  %sConnected!\n\n", icon("✓"))
+	return client, nil
+}
+
+// enterCode agrees on a key with the sender that showed code. The client
+// joins the relay once it starts receiving.
+func enterCode(opts options, code string, extra ...pulse.Option) (*pulse.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	say("  %sChecking code...\n\n", icon("🔑"))
+	token, key, err := codes.Exchange(ctx, opts.relay, code, false)
+	if err != nil {
+		return nil, err
+	}
+	return pulse.NewClient(pulse.Session{Token: token, Key: key}, opts.clientOptions(extra...)...), nil
+}
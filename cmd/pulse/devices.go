@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fromjyce/pulse"
+	"github.com/fromjyce/pulse/internal/pairing"
+)
+
+// deviceEvent is a paired device in JSON mode. The secret is left out.
+type deviceEvent struct {
+	Event    string    `json:"event"` // "paired", "device" or "revoked"
+	Name     string    `json:"name"`
+	Relay    string    `json:"relay"`
+	PairedAt time.Time `json:"paired_at"`
+}
+
+// cmdPair shows a QR code that hands a new secret to the phone, and keeps
+// the device once the phone opened it
+func cmdPair(opts options, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("the device needs a name, e.g. pulse pair phone")
+	}
+	if _, err := pairing.FindDevice(name); err == nil {
+		return fmt.Errorf("a device named %q is already paired, revoke it first with pulse devices revoke %s", name, name)
+	}
+	device, err := pairing.NewDevice(name, opts.relay)
+	if err != nil {
+		return err
+	}
+	computer, err := os.Hostname()
+	if err != nil || computer == "" {
+		computer = "computer"
+	}
+
+	say("\n  %sPulse - Pair %s\n\n", icon("🔗"), name)
+	if err := printLink(device.PairURL(computer), device.Room(), opts.relay, name); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(cancelOnSignal(), opts.timeout)
+	defer cancel()
+	if err := pairing.WaitForDevice(ctx, device); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("timeout waiting for %s to open the link", name)
+		}
+		return err
+	}
+	device.PairedAt = time.Now()
+	if err := pairing.SaveDevice(device); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+
+	emitJSON(deviceEvent{Event: "paired", Name: device.Name, Relay: device.Relay, PairedAt: device.PairedAt})
+	say("  %sPaired with %s\n\n", icon("✓"), name)
+	say("  Keep the page open on %s, or bookmark it, and send with:\n    pulse send --to %s <file>\n\n", name, name)
+	return nil
+}
+
+// cmdDevices lists or revokes paired devices
+func cmdDevices(args []string) error {
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "list":
+		return listDevices()
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: pulse devices revoke <name>")
+		}
+		device, err := pairing.FindDevice(args[1])
+		if err != nil {
+			return err
+		}
+		if err := pairing.RemoveDevice(device.Name); err != nil {
+			return err
+		}
+		emitJSON(deviceEvent{Event: "revoked", Name: device.Name, Relay: device.Relay, PairedAt: device.PairedAt})
+		say("\n  %sRevoked %s, it can no longer receive from this computer\n", icon("✓"), args[1])
+		say("  Tap Forget on its Pulse page to remove the pairing there too\n\n")
+		return nil
+	default:
+		return fmt.Errorf("unknown devices command %q, use list or revoke", command)
+	}
+}
+
+func listDevices() error {
+	devices, err := pairing.LoadDevices()
+	if err != nil {
+		return err
+	}
+	if mode == modeJSON {
+		for _, d := range devices {
+			emitJSON(deviceEvent{Event: "device", Name: d.Name, Relay: d.Relay, PairedAt: d.PairedAt})
+		}
+		return nil
+	}
+
+	if len(devices) == 0 {
+		say("\n  No paired devices, pair one with pulse pair <name>\n\n")
+		return nil
+	}
+	say("\n  %sPaired Devices\n\n", icon("🔗"))
+	say("  %-20s | %-19s | %s\n", "Name", "Paired", "Relay")
+	say("  %s\n", strings.Repeat("-", 70))
+	for _, d := range devices {
+		say("  %-20s | %-19s | %s\n", d.Name, d.PairedAt.Format("2006-01-02 15:04:05"), d.Relay)
+	}
+	say("\n")
+	return nil
+}
+
+// connectDevice invites the paired device called name to a new session and
+// blocks until it joins. The session has its own room and a key derived
+// for it alone.
+func connectDevice(opts options, name string, extra ...pulse.Option) (*pulse.Client, error) {
+	device, err := pairing.FindDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	session, err := device.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	say("  %sE2E Encrypted\n  %sWaiting for %s to open its Pulse page...\n\n", icon("🔒"), icon("⏳"), name)
+
+	// The device was paired through its relay, whatever --relay says
+	client := pulse.NewClient(pulse.Session{Token: session.Token, Key: session.Key}, opts.clientOptions(append(extra, pulse.WithRelay(device.Relay))...)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pairing.Invite(ctx, device, session)
+	if err := client.WaitForReceiver(context.Background()); err != nil {
+		return nil, err
+	}
+	say("  %sConnected!\n\n", icon("✓"))
+	return client, nil
+}
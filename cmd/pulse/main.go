@@ -1,37 +1,61 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
-	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/fromjyce/pulse"
 	"github.com/fromjyce/pulse/internal/history"
 	"github.com/fromjyce/pulse/internal/notify"
-	"github.com/fromjyce/pulse/internal/qr"
-	"github.com/fromjyce/pulse/internal/transfer"
 )
 
-const defaultRelay = "wss://pulse.relay.app"
+// options holds the global flags shared by all commands
+type options struct {
+	relay     string
+	debug     bool
+	chunkSize int
+	timeout   time.Duration
+	retries   int
+	notify    bool
+	compress  bool
+	delta     bool
+	json      bool
+	plain     bool
+}
+
+// out receives everything meant for the user. It switches to stderr when
+// stdout carries file data.
+var out io.Writer = os.Stdout
 
 func main() {
 	// Global flags
-	relay := flag.String("relay", defaultRelay, "Relay server URL")
-	debug := flag.Bool("debug", false, "Enable debug logging")
-	chunkSize := flag.Int("chunk-size", 65536, "Chunk size in bytes (default 64KB)")
-	timeout := flag.Duration("timeout", 5*time.Minute, "Transfer timeout (default 5m)")
-	retries := flag.Int("retries", 3, "Number of connection retries (default 3)")
-	notifyFlag := flag.Bool("notify", false, "Send desktop notification on completion")
+	var opts options
+	flag.StringVar(&opts.relay, "relay", pulse.DefaultRelay, "Relay server URL")
+	flag.BoolVar(&opts.debug, "debug", false, "Enable debug logging")
+	flag.IntVar(&opts.chunkSize, "chunk-size", 65536, "Chunk size in bytes (default 64KB)")
+	flag.DurationVar(&opts.timeout, "timeout", 5*time.Minute, "Transfer timeout (default 5m)")
+	flag.IntVar(&opts.retries, "retries", 3, "Number of connection retries (default 3)")
+	flag.BoolVar(&opts.notify, "notify", false, "Send desktop notification on completion")
+	flag.BoolVar(&opts.compress, "compress", false, "Compress chunks when the receiver supports it")
+	flag.BoolVar(&opts.delta, "delta", false, "Only send what changed in files the receiver already has")
+	flag.BoolVar(&opts.json, "json", false, "Print newline-delimited JSON events instead of text")
+	flag.BoolVar(&opts.plain, "plain", false, "Print plain text without emoji, QR codes or progress bars")
+	flag.Usage = printUsage
 
 	flag.Parse()
 	args := flag.Args()
+	setOutput(os.Stdout, opts)
 
 	if len(args) < 1 {
 		printUsage()
@@ -41,39 +65,147 @@ func main() {
 	var err error
 	switch args[0] {
 	case "send":
-		if len(args) < 2 {
-			fmt.Println("Usage: pulse send <file> [file2 file3 ...]")
+		fs := flag.NewFlagSet("send", flag.ExitOnError)
+		fs.Usage = printUsage
+		name := fs.String("name", "stdin", "File name to announce when sending from stdin")
+		text := fs.Bool("text", false, "Send text from the arguments or stdin instead of files")
+		recipients := fs.Int("recipients", 1, "Send the same files to this many receivers")
+		to := fs.String("to", "", "Send to a paired device instead of showing a QR code")
+		code := fs.Bool("code", false, "Show a short code to type on another terminal instead of a QR code")
+		fs.Parse(args[1:])
+		if *recipients < 1 || *recipients > pulse.MaxRecipients {
+			printError(fmt.Errorf("--recipients must be between 1 and %d", pulse.MaxRecipients))
 			os.Exit(1)
 		}
-		err = cmdSend(*relay, args[1:], *debug, *chunkSize, *timeout, *retries, *notifyFlag)
+		if *recipients > 1 && (*text || (fs.NArg() == 1 && fs.Arg(0) == "-")) {
+			printError(fmt.Errorf("--recipients only works with files"))
+			os.Exit(1)
+		}
+		if *recipients > 1 && (*to != "" || *code) {
+			printError(fmt.Errorf("--to and --code reach one receiver and cannot be combined with --recipients"))
+			os.Exit(1)
+		}
+		if *to != "" && *code {
+			printError(fmt.Errorf("--to and --code cannot be combined"))
+			os.Exit(1)
+		}
+		rt := route{device: *to, code: *code}
+		if *text {
+			err = cmdSendText(opts, rt, fs.Args())
+			break
+		}
+		if fs.NArg() < 1 {
+			printError(fmt.Errorf("usage: pulse send <file|dir> [file2 dir2 ...]"))
+			os.Exit(1)
+		}
+		switch {
+		case fs.NArg() == 1 && fs.Arg(0) == "-":
+			err = cmdSendStdin(opts, rt, *name)
+		case *recipients > 1:
+			err = cmdBroadcast(opts, fs.Args(), *recipients)
+		default:
+			err = cmdSend(opts, rt, fs.Args())
+		}
 	case "receive":
+		fs := flag.NewFlagSet("receive", flag.ExitOnError)
+		fs.Usage = printUsage
+		toStdout := fs.Bool("stdout", false, "Write the received file to stdout")
+		asText := fs.Bool("text", false, "Print text sent from the phone instead of saving a file")
+		onConflict := fs.String("on-conflict", "rename", "What to do with files that already exist: rename, overwrite, skip or ask")
+		preserve := fs.Bool("preserve", false, "Keep modification times, directory modes and symlinks")
+		var maxSize, maxTotal byteSize
+		fs.Var(&maxSize, "max-size", "Largest file accepted, e.g. 500M or 2G")
+		fs.Var(&maxTotal, "max-total", "Largest batch accepted, e.g. 10G")
+		yes := fs.Bool("yes", false, "Accept incoming transfers without asking")
+		code := fs.String("code", "", "Receive with the code shown by pulse send --code")
+		fs.Parse(args[1:])
+		recvOpts := []pulse.Option{pulse.WithLimits(int64(maxSize), int64(maxTotal))}
+		if *asText {
+			// Printing writes nothing to disk, so there is nothing to accept.
+			// The text goes to stdout, inside the events in JSON mode.
+			if !opts.json {
+				setOutput(os.Stderr, opts)
+			}
+			err = cmdReceiveText(opts, *code, recvOpts)
+			break
+		}
+		if !*yes {
+			recvOpts = append(recvOpts, pulse.WithAccept(askAccept))
+		}
+		if *toStdout {
+			setOutput(os.Stderr, opts)
+			err = cmdReceiveStdout(opts, *code, recvOpts)
+			break
+		}
+		policy, perr := pulse.ParseConflictPolicy(*onConflict)
+		if perr != nil {
+			printError(perr)
+			os.Exit(1)
+		}
+		recvOpts = append(recvOpts, pulse.WithConflictPolicy(policy, askConflict))
+		if *preserve {
+			recvOpts = append(recvOpts, pulse.WithPreserve())
+		}
 		dir := "."
-		if len(args) >= 2 {
-			dir = args[1]
+		if fs.NArg() >= 1 {
+			dir = fs.Arg(0)
 		}
-		err = cmdReceive(*relay, dir, *debug, *timeout, *notifyFlag)
+		err = cmdReceive(opts, *code, dir, recvOpts)
+	case "pair":
+		if len(args) != 2 {
+			printError(fmt.Errorf("usage: pulse pair <name>"))
+			os.Exit(1)
+		}
+		err = cmdPair(opts, args[1])
+	case "devices":
+		err = cmdDevices(args[1:])
 	case "history":
 		err = cmdHistory()
 	default:
-		fmt.Printf("Unknown command: %s\n", args[0])
+		printError(fmt.Errorf("unknown command %q", args[0]))
 		printUsage()
 		os.Exit(1)
 	}
 
 	if err != nil {
-		fmt.Printf("\n  ✗ Error: %v\n\n", err)
+		printError(err)
 		os.Exit(1)
 	}
 }
 
+// printUsage goes to stderr in JSON mode, where stdout only carries events
 func printUsage() {
-	fmt.Println(`
+	w := out
+	if mode == modeJSON {
+		w = os.Stderr
+	}
+	fmt.Fprint(w, `
   Pulse - Secure file transfer between terminal and phone
 
   Usage:
-    pulse send <file> [file2 file3 ...]    Send one or more files
+    pulse send <file|dir> [file2 dir2 ...] Send files or whole directories
+    pulse send [--name <n>] -               Send stdin
+    pulse send --text [text]                Send text, from stdin if not given
+    pulse send --recipients <n> <file|dir>  Send the same files to n phones,
+                                            which all open the same link
+    pulse send --to <device> <file|dir>     Send to a paired phone, no QR code
+    pulse send --code <file|dir>            Show a short code to type on
+                                            another terminal instead of a link
     pulse receive [dir]                     Receive files
-    pulse history                            Show transfer history
+    pulse receive --on-conflict <p> [dir]   rename (default), overwrite, skip
+                                            or ask when a file already exists
+    pulse receive --preserve [dir]          Also keep exact modes, modification
+                                            times and symlinks
+    pulse receive --max-size <n> [dir]      Refuse files larger than n
+    pulse receive --max-total <n> [dir]     Refuse batches larger than n
+    pulse receive --yes [dir]               Accept without asking first
+    pulse receive --stdout                  Receive a file to stdout
+    pulse receive --text                    Print text typed on the phone
+    pulse receive --code <code> [dir]       Receive from pulse send --code
+    pulse pair <name>                       Pair a phone for pulse send --to
+    pulse devices [list]                    Show paired devices
+    pulse devices revoke <name>             Forget a paired device
+    pulse history                           Show transfer history
 
   Flags:
     --relay <url>       Relay server URL (default: wss://pulse.relay.app)
@@ -82,205 +214,719 @@ func printUsage() {
     --timeout <d>       Transfer timeout (default: 5m)
     --retries <n>       Connection retries (default: 3)
     --notify            Send desktop notification on completion
+    --compress          Compress text-like files on the way (skipped for
+                        already compressed formats and older receivers)
+    --delta             Only send what changed in files the receiver
+                        already has, such as a new build of the same file.
+                        The receiver needs --on-conflict=overwrite to
+                        update the file in place rather than keep a copy
+    --json              Print one JSON event per line: the link, the peer
+                        connecting, progress, each file and a summary
+    --plain             No emoji, QR codes or progress bars, the default
+                        when the output is not a terminal
 
   Examples:
     pulse send document.pdf
     pulse send file1.txt file2.txt file3.txt
+    pulse send ./project
+    pulse send --recipients 5 handout.pdf
+    pulse pair phone
+    pulse send --to phone photo.jpg
+    pulse send --code build.tar
+    pulse receive --code 7-purple-sausage ~/Downloads
+    tar c dir | pulse send --name dir.tar -
+    pulse send --text "https://example.com/reset?code=4711"
+    git diff | pulse send --text
     pulse receive ~/Downloads
+    pulse receive --on-conflict=skip ~/Downloads
+    pulse receive --preserve ~/src
+    pulse receive --max-size 2G --max-total 10G ~/Downloads
+    pulse receive --yes --on-conflict=rename ~/inbox
+    pulse receive --stdout | tar x
     pulse --debug send config.yaml
+    pulse --compress send server.log
+    pulse --delta send build/app.tar
+    pulse --json send report.pdf | jq -r 'select(.event=="link").url'
+
 `)
 }
 
-func cmdSend(relay string, filePaths []string, debug bool, chunkSize int, timeout time.Duration, retries int, notifyFlag bool) error {
-	// Validate files exist
-	for _, filePath := range filePaths {
-		if _, err := os.Stat(filePath); err != nil {
-			return fmt.Errorf("file not found: %s", filePath)
-		}
+// clientOptions turns the global flags into client options, followed by
+// extra
+func (o options) clientOptions(extra ...pulse.Option) []pulse.Option {
+	clientOpts := []pulse.Option{
+		pulse.WithRelay(o.relay),
+		pulse.WithChunkSize(o.chunkSize),
+		pulse.WithTimeout(o.timeout),
+		pulse.WithRetries(o.retries),
+	}
+	if o.compress {
+		clientOpts = append(clientOpts, pulse.WithCompression())
+	}
+	if o.delta {
+		clientOpts = append(clientOpts, pulse.WithDelta())
 	}
+	if o.debug {
+		clientOpts = append(clientOpts, pulse.WithLogger(debugLog))
+	}
+	if mode == modeJSON {
+		clientOpts = append(clientOpts, pulse.WithObserver(jsonObserver()))
+	}
+	return append(clientOpts, extra...)
+}
 
-	token := genToken()
-	key, _ := crypto.GenerateKey()
+func debugLog(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[DEBUG] "+format+"\n", args...)
+}
 
-	httpRelay := strings.Replace(strings.Replace(relay, "wss://", "https://", 1), "ws://", "http://", 1)
-	url := fmt.Sprintf("%s/d/%s#%s", httpRelay, token, crypto.KeyToBase64(key))
+// route is how a sender reaches its receiver: through a link by default,
+// a paired device or a short code
+type route struct {
+	device string // send --to
+	code   bool   // send --code
+}
 
-	fmt.Println("\n  🚀 Pulse - Send\n")
-	if len(filePaths) == 1 {
-		stat, _ := os.Stat(filePaths[0])
-		fmt.Printf("  📄 File: %s (%s)\n\n", stat.Name(), fmtBytes(stat.Size()))
-	} else {
-		totalSize := int64(0)
-		for _, fp := range filePaths {
-			if stat, err := os.Stat(fp); err == nil {
-				totalSize += stat.Size()
-			}
-		}
-		fmt.Printf("  📦 Batch: %d files (%s total)\n\n", len(filePaths), fmtBytes(totalSize))
+// connectSender shows the download link, invites the paired device or
+// shows a code, and blocks until the receiver joins
+func connectSender(opts options, rt route, extra ...pulse.Option) (*pulse.Client, error) {
+	switch {
+	case rt.device != "":
+		return connectDevice(opts, rt.device, extra...)
+	case rt.code:
+		return connectCode(opts, extra...)
 	}
-
-	if err := qr.GenerateTerminal(url); err != nil {
-		return err
+	session, err := pulse.NewSession()
+	if err != nil {
+		return nil, err
 	}
-
-	fmt.Printf("\n  📲 %s\n\n  🔒 E2E Encrypted\n  ⏳ Waiting for receiver...\n\n", url)
-
-	cfg := transfer.Config{
-		ChunkSize: chunkSize,
-		Timeout:   timeout,
-		Retries:   retries,
-		Debug:     debug,
+	if err := printLink(session.DownloadURL(opts.relay), session.Token, opts.relay, "receiver"); err != nil {
+		return nil, err
 	}
 
-	sender := transfer.NewSender(relay, token, key, cfg)
-	if err := sender.Connect(); err != nil {
-		return err
+	client := pulse.NewClient(session, opts.clientOptions(extra...)...)
+	if err := client.WaitForReceiver(context.Background()); err != nil {
+		return nil, err
 	}
-	defer sender.Close()
+	say("  %sConnected!\n\n", icon("✓"))
+	return client, nil
+}
 
-	if err := sender.WaitForReceiver(timeout); err != nil {
-		return err
+// connectReceiver shows the upload link, or agrees on a key with the
+// sender that showed code. The client joins the relay once it starts
+// receiving.
+func connectReceiver(opts options, code string, extra ...pulse.Option) (*pulse.Client, error) {
+	if code != "" {
+		return enterCode(opts, code, extra...)
 	}
-	fmt.Println("  ✓ Connected!\n")
+	session, err := pulse.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := printLink(session.UploadURL(opts.relay), session.Token, opts.relay, "sender"); err != nil {
+		return nil, err
+	}
+
+	return pulse.NewClient(session, opts.clientOptions(extra...)...), nil
+}
 
-	// Setup signal handling for cancellation
+// cancelOnSignal returns a context that is cancelled on SIGINT or SIGTERM
+func cancelOnSignal() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigChan
-		fmt.Println("\n  ⚠ Cancelling transfer...")
+		say("\n  %sCancelling transfer...\n", icon("⚠"))
 		cancel()
 	}()
+	return ctx
+}
+
+func cmdSend(opts options, rt route, filePaths []string) error {
+	// Validate files exist and expand directories
+	entries, err := pulse.CollectEntries(filePaths)
+	if err != nil {
+		return err
+	}
+
+	say("\n  %sPulse - Send\n\n", icon("🚀"))
+	describeEntries(entries)
+
+	client, err := connectSender(opts, rt, pulse.WithObserver(progressObserver()))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx := cancelOnSignal()
 
 	startTime := time.Now()
 	totalSize := int64(0)
 
-	for i, filePath := range filePaths {
-		if debug {
-			fmt.Printf("  [DEBUG] Sending file %d/%d: %s\n", i+1, len(filePaths), filePath)
+	allStats, err := client.SendEntries(ctx, entries)
+
+	// Save delivered files to history, even if the batch failed part way
+	sentFiles := 0
+	skippedLinks := 0
+	unchanged := 0
+	var reused int64
+	verified := true
+	for i, stats := range allStats {
+		if stats.Skipped {
+			skippedLinks++
+			continue
 		}
-
-		progressFn := makeProgressFn(filePaths[i])
-		stats, err := sender.SendFile(ctx, filePath, progressFn)
-		if err != nil {
-			return err
+		if stats.Identical {
+			unchanged++
+			emitJSON(fileEvent{Event: "file", Name: entries[i].RelPath, Size: entries[i].Size, Checksum: stats.Checksum, Status: "skipped", Conflict: pulse.ActionIdentical})
+			history.SaveEntry(history.Entry{
+				Time:      time.Now(),
+				Direction: "send",
+				Filename:  entries[i].RelPath,
+				Size:      entries[i].Size,
+				Status:    "skipped",
+				Conflict:  pulse.ActionIdentical,
+			})
+			continue
 		}
+		if entries[i].IsDir || entries[i].LinkTarget != "" {
+			continue
+		}
+		sentFiles++
+		totalSize += entries[i].Size
+		reused += stats.Reused
+		verified = verified && stats.Verified
+		emitJSON(sentEvent(entries[i].RelPath, entries[i].Size, stats))
 
-		stat, _ := os.Stat(filePath)
-		totalSize += stat.Size()
-
-		// Save to history
 		histEntry := history.Entry{
 			Time:      time.Now(),
 			Direction: "send",
-			Filename:  stat.Name(),
-			Size:      stat.Size(),
+			Filename:  entries[i].RelPath,
+			Size:      entries[i].Size,
 			Duration:  stats.Duration,
 			Speed:     stats.Speed,
 			Status:    "ok",
+			Checksum:  stats.Checksum,
 		}
 		history.SaveEntry(histEntry)
 	}
+	if err != nil {
+		return err
+	}
 
 	totalDuration := time.Since(startTime)
 	avgSpeed := float64(totalSize) / totalDuration.Seconds()
 
-	fmt.Printf("\n  ✓ Done! (%s in %v @ %.0f KB/s)\n", fmtBytes(totalSize), fmtDuration(totalDuration), avgSpeed/1024)
-	fmt.Println("  ✓ Checksum verified\n")
+	printDone(sentFiles, totalSize, totalDuration, avgSpeed, verified)
+	if unchanged > 0 {
+		say("  %sSkipped %d file(s) the receiver already has\n", icon("="), unchanged)
+	}
+	if reused > 0 {
+		say("  %sSent only the changes, %s was already on the receiver\n", icon("Δ"), fmtBytes(reused))
+	}
+	if skippedLinks > 0 {
+		say("  %sSkipped %d symlink(s), the receiver does not keep them (pulse receive --preserve does)\n", icon("⚠"), skippedLinks)
+	}
+
+	if opts.notify {
+		notify.Notify("Pulse", fmt.Sprintf("✓ Sent %d file(s) successfully", sentFiles))
+	}
+
+	return nil
+}
+
+// describeEntries shows what is about to be sent
+func describeEntries(entries []pulse.Entry) {
+	if len(entries) == 1 && !entries[0].IsDir && entries[0].LinkTarget == "" {
+		say("  %sFile: %s (%s)\n\n", icon("📄"), entries[0].RelPath, fmtBytes(entries[0].Size))
+		return
+	}
+	fileCount, totalSize := countFiles(entries)
+	say("  %sBatch: %d files (%s total)\n\n", icon("📦"), fileCount, fmtBytes(totalSize))
+}
+
+// countFiles counts the regular files among entries and their size
+func countFiles(entries []pulse.Entry) (int, int64) {
+	count := 0
+	var size int64
+	for _, e := range entries {
+		if !e.IsDir && e.LinkTarget == "" {
+			count++
+			size += e.Size
+		}
+	}
+	return count, size
+}
+
+// cmdBroadcast sends the same files to several receivers that all open
+// one link. The room is prepared before the link is shown.
+func cmdBroadcast(opts options, filePaths []string, recipients int) error {
+	entries, err := pulse.CollectEntries(filePaths)
+	if err != nil {
+		return err
+	}
+	fileCount, totalSize := countFiles(entries)
+
+	say("\n  %sPulse - Send to %d recipients\n\n", icon("🚀"), recipients)
+	describeEntries(entries)
 
-	if notifyFlag {
-		notify.Notify("Pulse", fmt.Sprintf("✓ Sent %d file(s) successfully", len(filePaths)))
+	session, err := pulse.NewSession()
+	if err != nil {
+		return err
+	}
+	ctx := cancelOnSignal()
+	broadcast := pulse.NewBroadcast(session, recipients, opts.clientOptions(pulse.WithObserver(broadcastObserver(recipients, totalSize)))...)
+	if err := broadcast.Connect(ctx); err != nil {
+		return err
+	}
+	defer broadcast.Close()
+	if err := printLink(session.DownloadURL(opts.relay), session.Token, opts.relay, fmt.Sprintf("%d receivers", recipients)); err != nil {
+		return err
 	}
 
+	startTime := time.Now()
+	results, err := broadcast.SendEntries(ctx, entries)
+	totalDuration := time.Since(startTime)
+
+	delivered := 0
+	verified := true
+	// How many receivers got each file and how it went for the first, for
+	// the history
+	received := make([]int, len(entries))
+	first := make([]pulse.Stats, len(entries))
+	for r, result := range results {
+		files := 0
+		var size int64
+		allVerified := true
+		for i, stats := range result.Stats {
+			if stats.Skipped || entries[i].IsDir || entries[i].LinkTarget != "" {
+				continue
+			}
+			if received[i] == 0 {
+				first[i] = stats
+			}
+			received[i]++
+			files++
+			size += entries[i].Size
+			status, conflict := "ok", ""
+			if stats.Identical {
+				status, conflict = "skipped", pulse.ActionIdentical
+			} else {
+				allVerified = allVerified && stats.Verified
+			}
+			emitJSON(fileEvent{Event: "file", Recipient: r + 1, Name: entries[i].RelPath, Size: entries[i].Size, Checksum: stats.Checksum, Verified: stats.Verified, Status: status, Conflict: conflict, Duration: stats.Duration.Milliseconds(), Speed: stats.Speed})
+		}
+		event := recipientEvent{Event: "recipient", Recipient: r + 1, Files: files, Bytes: size, Verified: allVerified && result.Err == nil}
+		if result.Err != nil {
+			event.Error = result.Err.Error()
+		} else {
+			delivered++
+			verified = verified && allVerified
+		}
+		emitJSON(event)
+	}
+	for i, count := range received {
+		if count == 0 {
+			continue
+		}
+		status := "ok"
+		if count < recipients {
+			status = "partial"
+		}
+		history.SaveEntry(history.Entry{
+			Time:      time.Now(),
+			Direction: "send",
+			Filename:  entries[i].RelPath,
+			Size:      entries[i].Size,
+			Duration:  first[i].Duration,
+			Speed:     first[i].Speed,
+			Status:    status,
+			Checksum:  first[i].Checksum,
+		})
+	}
+
+	var speed float64
+	if totalDuration > 0 {
+		speed = float64(totalSize*int64(delivered)) / totalDuration.Seconds()
+	}
+	emitJSON(summaryEvent{Event: "summary", Files: fileCount, Bytes: totalSize, Duration: totalDuration.Milliseconds(), Speed: speed, Verified: verified && delivered > 0, Recipients: recipients, Delivered: delivered})
+	say("\n  %sSent %s to %d of %d recipients in %v\n", icon("✓"), fmtBytes(totalSize), delivered, recipients, fmtDuration(totalDuration))
+	if delivered > 0 {
+		printVerified(verified)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.notify {
+		notify.Notify("Pulse", fmt.Sprintf("✓ Sent %d file(s) to %d recipients", fileCount, recipients))
+	}
 	return nil
 }
 
-func cmdReceive(relay, destDir string, debug bool, timeout time.Duration, notifyFlag bool) error {
+func cmdSendStdin(opts options, rt route, name string) error {
+	say("\n  %sPulse - Send\n\n", icon("🚀"))
+	say("  %sStream: %s (from stdin)\n\n", icon("📄"), name)
+
+	client, err := connectSender(opts, rt, pulse.WithObserver(progressObserver()))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx := cancelOnSignal()
+
+	stats, err := client.Send(ctx, os.Stdin, pulse.FileInfo{Name: name, Size: -1})
+	if err != nil {
+		return err
+	}
+
+	histEntry := history.Entry{
+		Time:      time.Now(),
+		Direction: "send",
+		Filename:  name,
+		Size:      stats.BytesSent,
+		Duration:  stats.Duration,
+		Speed:     stats.Speed,
+		Status:    "ok",
+		Checksum:  stats.Checksum,
+	}
+	history.SaveEntry(histEntry)
+
+	emitJSON(sentEvent(name, stats.BytesSent, stats))
+	printDone(1, stats.BytesSent, stats.Duration, stats.Speed, stats.Verified)
+
+	if opts.notify {
+		notify.Notify("Pulse", fmt.Sprintf("✓ Sent %s successfully", name))
+	}
+
+	return nil
+}
+
+func cmdSendText(opts options, rt route, args []string) error {
+	text := strings.Join(args, " ")
+	if len(args) == 0 {
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, pulse.MaxTextSize+1))
+		if err != nil {
+			return fmt.Errorf("failed to read stdin: %w", err)
+		}
+		text = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	}
+	if text == "" {
+		return fmt.Errorf("nothing to send, pass the text as an argument or on stdin")
+	}
+
+	say("\n  %sPulse - Send\n\n", icon("🚀"))
+	say("  %sText: %s\n\n", icon("💬"), fmtBytes(int64(len(text))))
+
+	client, err := connectSender(opts, rt)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx := cancelOnSignal()
+
+	stats, err := client.SendText(ctx, text)
+	if err != nil {
+		return err
+	}
+
+	histEntry := history.Entry{
+		Time:      time.Now(),
+		Direction: "send",
+		Filename:  "(text)",
+		Size:      stats.BytesSent,
+		Duration:  stats.Duration,
+		Speed:     stats.Speed,
+		Status:    "ok",
+		Checksum:  stats.Checksum,
+	}
+	history.SaveEntry(histEntry)
+
+	emitJSON(sentEvent("(text)", stats.BytesSent, stats))
+	emitJSON(summaryEvent{Event: "summary", Files: 1, Bytes: stats.BytesSent, Duration: stats.Duration.Milliseconds(), Speed: stats.Speed, Verified: stats.Verified})
+	say("  %sSent!\n", icon("✓"))
+	printVerified(stats.Verified)
+
+	if opts.notify {
+		notify.Notify("Pulse", "✓ Sent text successfully")
+	}
+
+	return nil
+}
+
+func cmdReceive(opts options, code, destDir string, recvOpts []pulse.Option) error {
 	// Create destination directory if it doesn't exist
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
-	token := genToken()
-	key, _ := crypto.GenerateKey()
+	say("\n  %sPulse - Receive\n\n", icon("🚀"))
+	say("  %sDestination: %s\n\n", icon("📍"), destDir)
 
-	httpRelay := strings.Replace(strings.Replace(relay, "wss://", "https://", 1), "ws://", "http://", 1)
-	url := fmt.Sprintf("%s/u/%s#%s", httpRelay, token, crypto.KeyToBase64(key))
+	client, err := connectReceiver(opts, code, append(recvOpts, pulse.WithObserver(progressObserver()))...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx := cancelOnSignal()
 
-	fmt.Println("\n  🚀 Pulse - Receive\n")
-	fmt.Printf("  📍 Destination: %s\n\n", destDir)
+	files, err := client.Receive(ctx, pulse.ToDir(destDir))
+
+	received := 0
+	var totalSize int64
+	var totalDuration time.Duration
+	verified := true
+	for _, f := range files {
+		if f.Metadata.IsDir {
+			continue
+		}
+		if f.Metadata.LinkTarget != "" {
+			if f.Conflict != pulse.ActionSkipped {
+				say("\n  %sLinked: %s -> %s", icon("✓"), f.Path, f.Metadata.LinkTarget)
+			}
+			continue
+		}
+
+		status := "ok"
+		if f.Conflict == pulse.ActionSkipped || f.Conflict == pulse.ActionIdentical {
+			status = "skipped"
+		}
 
-	if err := qr.GenerateTerminal(url); err != nil {
+		// Save to history
+		histEntry := history.Entry{
+			Time:      time.Now(),
+			Direction: "receive",
+			Filename:  f.Metadata.RelPath(),
+			Size:      f.Stats.BytesSent,
+			Duration:  f.Stats.Duration,
+			Speed:     f.Stats.Speed,
+			Status:    status,
+			Checksum:  f.Metadata.Checksum,
+			Conflict:  f.Conflict,
+		}
+		history.SaveEntry(histEntry)
+		emitJSON(receivedEvent(f, status))
+
+		switch f.Conflict {
+		case pulse.ActionIdentical:
+			say("\n  %sUnchanged: %s", icon("="), f.Path)
+			continue
+		case pulse.ActionSkipped:
+			say("\n  %sSkipped: %s already exists", icon("⚠"), f.Metadata.RelPath())
+			continue
+		case pulse.ActionRenamed:
+			say("\n  %sSaved: %s (%s already exists)", icon("✓"), f.Path, f.Metadata.RelPath())
+		case pulse.ActionOverwritten:
+			say("\n  %sSaved: %s (overwritten)", icon("✓"), f.Path)
+		default:
+			say("\n  %sSaved: %s", icon("✓"), f.Path)
+		}
+		received++
+		verified = verified && f.Stats.Verified
+		totalSize += f.Stats.BytesSent
+		totalDuration += f.Stats.Duration
+	}
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("\n  📲 %s\n\n  🔒 E2E Encrypted\n  ⏳ Waiting for sender...\n\n", url)
+	var avgSpeed float64
+	if totalDuration > 0 {
+		avgSpeed = float64(totalSize) / totalDuration.Seconds()
+	}
+	say("\n")
+	printDone(received, totalSize, totalDuration, avgSpeed, verified)
+
+	if opts.notify {
+		if len(files) == 1 {
+			notify.Notify("Pulse", fmt.Sprintf("✓ Received %s successfully", filepath.Base(files[0].Path)))
+		} else {
+			notify.Notify("Pulse", fmt.Sprintf("✓ Received %d files successfully", len(files)))
+		}
+	}
+
+	return nil
+}
 
-	receiver := transfer.NewReceiverWithDebug(relay, token, key, debug)
-	if err := receiver.Connect(); err != nil {
+func cmdReceiveStdout(opts options, code string, recvOpts []pulse.Option) error {
+	say("\n  %sPulse - Receive\n\n", icon("🚀"))
+	say("  %sDestination: stdout\n\n", icon("📍"))
+
+	client, err := connectReceiver(opts, code, append(recvOpts, pulse.WithObserver(progressObserver()))...)
+	if err != nil {
 		return err
 	}
-	defer receiver.Close()
+	defer client.Close()
 
-	// Setup signal handling
-	ctx, cancel := context.WithCancel(context.Background())
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		fmt.Println("\n  ⚠ Cancelling transfer...")
-		cancel()
-	}()
+	ctx := cancelOnSignal()
 
-	progressFn := func(received, total int64) {
-		pct := float64(received) / float64(total) * 100
-		speed := float64(received) / time.Since(time.Now().Add(-time.Second)).Seconds()
-		if speed == 0 {
-			speed = 1 // Avoid division by zero
+	files, err := client.Receive(ctx, pulse.ToWriter(os.Stdout))
+	if err != nil {
+		return err
+	}
+	meta, stats := files[0].Metadata, files[0].Stats
+
+	histEntry := history.Entry{
+		Time:      time.Now(),
+		Direction: "receive",
+		Filename:  meta.RelPath(),
+		Size:      stats.BytesSent,
+		Duration:  stats.Duration,
+		Speed:     stats.Speed,
+		Status:    "ok",
+		Checksum:  meta.Checksum,
+	}
+	history.SaveEntry(histEntry)
+
+	emitJSON(receivedEvent(files[0], "ok"))
+	printDone(1, stats.BytesSent, stats.Duration, stats.Speed, stats.Verified)
+
+	if opts.notify {
+		notify.Notify("Pulse", fmt.Sprintf("✓ Received %s successfully", meta.RelPath()))
+	}
+
+	return nil
+}
+
+// stdinLines is shared by every prompt so buffered input is not lost
+var stdinLines = bufio.NewReader(os.Stdin)
+
+// askAccept shows what the sender offers and asks whether to take it.
+// Anything but yes declines, including a closed stdin.
+func askAccept(meta pulse.Metadata) bool {
+	name := meta.RelPath()
+	if meta.IsDir {
+		name += "/"
+	}
+	details := "unknown size"
+	if meta.Size >= 0 && !meta.Stream {
+		details = fmtBytes(meta.Size)
+	}
+	if meta.MimeType != "" {
+		details += ", " + meta.MimeType
+	}
+	prompt("  %sIncoming: %s (%s)\n", icon("📥"), name, details)
+	if meta.BatchTotal > 1 {
+		prompt("     + %d more in this batch\n", meta.BatchTotal-1)
+	}
+	prompt("  Accept? [y/N] ")
+	line, _ := stdinLines.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		prompt("\n")
+		return true
+	}
+	return false
+}
+
+// askConflict asks what to do with a file that already exists. It renames
+// when stdin is closed.
+func askConflict(path string) pulse.ConflictPolicy {
+	for {
+		prompt("\n  %s%s already exists. [r]ename, [o]verwrite or [s]kip? ", icon("⚠"), path)
+		line, err := stdinLines.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "r", "rename", "":
+			return pulse.ConflictRename
+		case "o", "overwrite":
+			return pulse.ConflictOverwrite
+		case "s", "skip":
+			return pulse.ConflictSkip
+		}
+		if err != nil {
+			return pulse.ConflictRename
 		}
-		fmt.Printf("\r  [%-40s] %.0f%% | %.1f MB/s",
-			strings.Repeat("█", int(pct/2.5))+strings.Repeat("░", 40-int(pct/2.5)),
-			pct, speed/(1024*1024))
 	}
+}
+
+func cmdReceiveText(opts options, code string, recvOpts []pulse.Option) error {
+	say("\n  %sPulse - Receive\n\n", icon("🚀"))
+	say("  %sWaiting for text\n\n", icon("💬"))
+
+	client, err := connectReceiver(opts, code, recvOpts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx := cancelOnSignal()
 
-	savedPath, stats, err := receiver.ReceiveFile(ctx, destDir, progressFn)
+	var buf strings.Builder
+	files, err := client.Receive(ctx, pulse.ToText(&buf))
 	if err != nil {
 		return err
 	}
+	text, meta, stats := buf.String(), files[0].Metadata, files[0].Stats
 
-	// Save to history
-	fi, _ := os.Stat(savedPath)
 	histEntry := history.Entry{
 		Time:      time.Now(),
 		Direction: "receive",
-		Filename:  fi.Name(),
-		Size:      fi.Size(),
+		Filename:  "(text)",
+		Size:      stats.BytesSent,
 		Duration:  stats.Duration,
 		Speed:     stats.Speed,
 		Status:    "ok",
+		Checksum:  meta.Checksum,
 	}
 	history.SaveEntry(histEntry)
 
-	fmt.Printf("\n  ✓ Saved: %s\n", savedPath)
-	fmt.Printf("  ✓ Done! (%s in %v @ %.0f KB/s)\n", fmtBytes(stats.BytesSent), fmtDuration(stats.Duration), stats.Speed/1024)
-	fmt.Println("  ✓ Checksum verified\n")
+	if mode == modeJSON {
+		emitJSON(receivedEvent(files[0], "ok"))
+		emitJSON(textEvent{Event: "text", Text: text})
+		emitJSON(summaryEvent{Event: "summary", Files: 1, Bytes: stats.BytesSent, Duration: stats.Duration.Milliseconds(), Speed: stats.Speed, Verified: stats.Verified})
+		return nil
+	}
+	say("  %sReceived:\n\n", icon("✓"))
+	if isTerminal(os.Stdout) {
+		// Whoever sent the text must not be able to drive the terminal
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		text = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				return unicode.ReplacementChar
+			}
+			return r
+		}, text)
+	}
+	fmt.Fprint(os.Stdout, text)
+	if !strings.HasSuffix(text, "\n") {
+		fmt.Fprintln(os.Stdout)
+	}
 
-	if notifyFlag {
-		notify.Notify("Pulse", fmt.Sprintf("✓ Received %s successfully", fi.Name()))
+	if opts.notify {
+		notify.Notify("Pulse", "✓ Received text")
 	}
 
 	return nil
 }
 
-func cmdHistory() error {
-	return history.PrintHistory()
+// isTerminal reports whether f is an interactive terminal rather than a pipe
+// or a file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func genToken() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// historyEvent is one history entry in JSON mode
+type historyEvent struct {
+	Event string `json:"event"` // "history"
+	history.Entry
+}
+
+func cmdHistory() error {
+	if mode != modeJSON {
+		return history.PrintHistory(mode == modePlain)
+	}
+	entries, err := history.LoadEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		emitJSON(historyEvent{Event: "history", Entry: e})
+	}
+	return nil
 }
 
 func fmtBytes(b int64) string {
@@ -294,6 +940,38 @@ func fmtBytes(b int64) string {
 	return fmt.Sprintf("%.1f GB", float64(b)/(1024*1024*1024))
 }
 
+// byteSize is a flag value in bytes that accepts K, M and G suffixes
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return fmtBytes(int64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1024
+	case strings.HasSuffix(s, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		unit = 1024 * 1024 * 1024
+	case strings.HasSuffix(s, "T"):
+		unit = 1024 * 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * float64(unit))
+	return nil
+}
+
 func fmtDuration(d time.Duration) string {
 	if d < time.Second {
 		return fmt.Sprintf("%dms", d.Milliseconds())
@@ -303,11 +981,33 @@ func fmtDuration(d time.Duration) string {
 	return fmt.Sprintf("%.1fm", d.Minutes())
 }
 
-func makeProgressFn(filePath string) func(sent, total int64) {
-	return func(sent, total int64) {
-		pct := float64(sent) / float64(total) * 100
-		fmt.Printf("\r  [%-40s] %.0f%%",
-			strings.Repeat("█", int(pct/2.5))+strings.Repeat("░", 40-int(pct/2.5)),
-			pct)
+// printDone sums up a finished transfer
+func printDone(files int, size int64, duration time.Duration, speed float64, verified bool) {
+	emitJSON(summaryEvent{Event: "summary", Files: files, Bytes: size, Duration: duration.Milliseconds(), Speed: speed, Verified: verified})
+	say("\n  %sDone! (%s in %v @ %.0f KB/s)\n", icon("✓"), fmtBytes(size), fmtDuration(duration), speed/1024)
+	printVerified(verified)
+}
+
+// printVerified reports whether every file's checksum was confirmed. Phone
+// pages may not be able to compute one.
+func printVerified(verified bool) {
+	if verified {
+		say("  %sChecksum verified\n\n", icon("✓"))
+	} else {
+		say("  %sChecksum not confirmed by the other side\n\n", icon("⚠"))
+	}
+}
+
+// sentEvent is the JSON result of a file that was sent
+func sentEvent(name string, size int64, stats pulse.Stats) fileEvent {
+	return fileEvent{Event: "file", Name: name, Size: size, Checksum: stats.Checksum, Verified: stats.Verified, Status: "ok", Duration: stats.Duration.Milliseconds(), Speed: stats.Speed}
+}
+
+// receivedEvent is the JSON result of a file that arrived
+func receivedEvent(f pulse.ReceivedFile, status string) fileEvent {
+	checksum := f.Stats.Checksum
+	if checksum == "" {
+		checksum = f.Metadata.Checksum
 	}
+	return fileEvent{Event: "file", Name: f.Metadata.RelPath(), Path: f.Path, Size: f.Stats.BytesSent, Checksum: checksum, Verified: f.Stats.Verified, Status: status, Conflict: f.Conflict, Duration: f.Stats.Duration.Milliseconds(), Speed: f.Stats.Speed}
 }
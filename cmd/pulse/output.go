@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fromjyce/pulse"
+	"github.com/fromjyce/pulse/internal/qr"
+)
+
+// outputMode decides how commands talk to the user
+type outputMode int
+
+const (
+	modeFancy outputMode = iota // emoji, QR codes and progress bars
+	modePlain                   // plain lines for logs and pipes
+	modeJSON                    // one JSON event per line for scripts
+)
+
+var mode = modeFancy
+
+// setOutput sends user output to f. Without --json or --plain, output is
+// plain unless f is a terminal.
+func setOutput(f *os.File, opts options) {
+	out = f
+	switch {
+	case opts.json:
+		mode = modeJSON
+	case opts.plain || !isTerminal(f):
+		mode = modePlain
+	default:
+		mode = modeFancy
+	}
+}
+
+// say prints text for people, which JSON mode leaves out
+func say(format string, args ...interface{}) {
+	if mode != modeJSON {
+		fmt.Fprintf(out, format, args...)
+	}
+}
+
+// icon decorates a line in fancy mode
+func icon(s string) string {
+	if mode != modeFancy {
+		return ""
+	}
+	return s + " "
+}
+
+// prompt asks a question on the terminal. In JSON mode it goes to stderr
+// to keep the events on out parseable.
+func prompt(format string, args ...interface{}) {
+	if mode == modeJSON {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
+	}
+	fmt.Fprintf(out, format, args...)
+}
+
+// Events printed in JSON mode, one per line. Sizes are in bytes, speeds in
+// bytes/sec and durations in milliseconds.
+type (
+	linkEvent struct {
+		Event string `json:"event"` // "link"
+		URL   string `json:"url"`
+		Token string `json:"token"`
+		Relay string `json:"relay"`
+	}
+	// codeEvent replaces the link with send --code
+	codeEvent struct {
+		Event string `json:"event"` // "code"
+		Code  string `json:"code"`
+		Relay string `json:"relay"`
+	}
+	connectedEvent struct {
+		Event     string `json:"event"` // "connected", or "reconnected" when the peer rejoined
+		Recipient int    `json:"recipient,omitempty"`
+	}
+	progressEvent struct {
+		Event     string  `json:"event"` // "progress"
+		Recipient int     `json:"recipient,omitempty"`
+		Index     int     `json:"index"`
+		Name      string  `json:"name"`
+		Bytes     int64   `json:"bytes"`
+		Total     int64   `json:"total"` // -1 for streams
+		Speed     float64 `json:"speed"`
+	}
+	retryEvent struct {
+		Event     string `json:"event"` // "retry"
+		Recipient int    `json:"recipient,omitempty"`
+		Attempt   int    `json:"attempt"`
+		Max       int    `json:"max"`
+		Error     string `json:"error"`
+	}
+	fileEvent struct {
+		Event     string  `json:"event"` // "file"
+		Recipient int     `json:"recipient,omitempty"`
+		Name      string  `json:"name"`
+		Path      string  `json:"path,omitempty"` // where it was saved
+		Size      int64   `json:"size"`
+		Checksum  string  `json:"checksum,omitempty"`
+		Verified  bool    `json:"verified"`
+		Status    string  `json:"status"`             // ok or skipped
+		Conflict  string  `json:"conflict,omitempty"` // renamed, overwritten, skipped or identical
+		Duration  int64   `json:"duration_ms"`
+		Speed     float64 `json:"speed"`
+	}
+	textEvent struct {
+		Event string `json:"event"` // "text"
+		Text  string `json:"text"`
+	}
+	// recipientEvent is the outcome of a broadcast for one receiver
+	recipientEvent struct {
+		Event     string `json:"event"` // "recipient"
+		Recipient int    `json:"recipient"`
+		Files     int    `json:"files"`
+		Bytes     int64  `json:"bytes"`
+		Verified  bool   `json:"verified"`
+		Error     string `json:"error,omitempty"`
+	}
+	summaryEvent struct {
+		Event      string  `json:"event"` // "summary"
+		Files      int     `json:"files"`
+		Bytes      int64   `json:"bytes"`
+		Duration   int64   `json:"duration_ms"`
+		Speed      float64 `json:"speed"`
+		Verified   bool    `json:"verified"`
+		Recipients int     `json:"recipients,omitempty"` // of a broadcast
+		Delivered  int     `json:"delivered,omitempty"`  // recipients that got every file
+	}
+	errorEvent struct {
+		Event string `json:"event"` // "error"
+		Error string `json:"error"`
+	}
+)
+
+// emitJSON prints one event in JSON mode
+func emitJSON(v interface{}) {
+	if mode != modeJSON {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(out, "%s\n", data)
+}
+
+// printError reports the error a command failed with
+func printError(err error) {
+	if mode == modeJSON {
+		emitJSON(errorEvent{Event: "error", Error: err.Error()})
+		return
+	}
+	say("\n  %sError: %v\n\n", icon("✗"), err)
+}
+
+// printLink shows where the other side has to go, as a QR code in fancy
+// mode
+func printLink(url, token, relay, waitingFor string) error {
+	emitJSON(linkEvent{Event: "link", URL: url, Token: token, Relay: relay})
+	if mode == modeFancy {
+		if err := qr.GenerateTerminalTo(out, url); err != nil {
+			return err
+		}
+	}
+	say("\n  %s%s\n\n  %sE2E Encrypted\n  %sWaiting for %s...\n\n", icon("📲"), url, icon("🔒"), icon("⏳"), waitingFor)
+	return nil
+}
+
+// progressObserver follows transfers: as JSON events, or as one progress
+// bar per file in fancy mode, starting a new line whenever the batch moves
+// on. Retries are noted in between.
+func progressObserver() pulse.Observer {
+	if mode == modeJSON {
+		return jsonObserver()
+	}
+	label := ""
+	drawn := false
+	return pulse.ObserverFunc(func(e pulse.Event) {
+		switch e := e.(type) {
+		case pulse.FileStartEvent:
+			if drawn {
+				fmt.Fprintln(out)
+				drawn = false
+			}
+			label = ""
+			if e.Metadata.BatchTotal > 1 {
+				label = fmt.Sprintf("%d/%d ", e.Index+1, e.Metadata.BatchTotal)
+			}
+		case pulse.ProgressEvent:
+			if mode != modeFancy {
+				return
+			}
+			drawn = true
+			if e.Total < 0 {
+				fmt.Fprintf(out, "\r  %s%s | %.1f MB/s   ", label, fmtBytes(e.Bytes), e.Speed/(1024*1024))
+				return
+			}
+			pct := 100.0
+			if e.Total > 0 {
+				pct = float64(e.Bytes) / float64(e.Total) * 100
+			}
+			fmt.Fprintf(out, "\r  %s[%-40s] %.0f%% | %.1f MB/s",
+				label,
+				strings.Repeat("█", int(pct/2.5))+strings.Repeat("░", 40-int(pct/2.5)),
+				pct, e.Speed/(1024*1024))
+		case pulse.FileEndEvent:
+			// Samples are throttled, so show where a stream really ended
+			if drawn && e.Err == nil && e.Metadata.Size < 0 {
+				fmt.Fprintf(out, "\r  %s%s | %.1f MB/s   ", label, fmtBytes(e.Stats.BytesSent), e.Stats.Speed/(1024*1024))
+			}
+		case pulse.RetryEvent:
+			if drawn {
+				fmt.Fprintln(out)
+				drawn = false
+			}
+			fmt.Fprintf(out, "  %sRetrying (%d/%d): %v\n", icon("↻"), e.Attempt, e.Max, e.Err)
+		}
+	})
+}
+
+// jsonObserver prints the peer joining, progress samples and retries as
+// JSON events, tagged with the recipient in broadcasts. Results are printed
+// by the commands once they are known.
+func jsonObserver() pulse.Observer {
+	joined := map[int]bool{}
+	names := map[[2]int]string{}
+	var observe func(recipient int, e pulse.Event)
+	observe = func(recipient int, e pulse.Event) {
+		switch e := e.(type) {
+		case pulse.RecipientEvent:
+			observe(e.Recipient+1, e.Event)
+		case pulse.PeerJoinedEvent:
+			event := "connected"
+			if joined[recipient] {
+				event = "reconnected"
+			}
+			joined[recipient] = true
+			emitJSON(connectedEvent{Event: event, Recipient: recipient})
+		case pulse.FileStartEvent:
+			names[[2]int{recipient, e.Index}] = e.Metadata.RelPath()
+		case pulse.ProgressEvent:
+			name := names[[2]int{recipient, e.Index}]
+			emitJSON(progressEvent{Event: "progress", Recipient: recipient, Index: e.Index, Name: name, Bytes: e.Bytes, Total: e.Total, Speed: e.Speed})
+		case pulse.RetryEvent:
+			emitJSON(retryEvent{Event: "retry", Recipient: recipient, Attempt: e.Attempt, Max: e.Max, Error: e.Err.Error()})
+		}
+	}
+	return pulse.ObserverFunc(func(e pulse.Event) { observe(0, e) })
+}
+
+// recipient is what broadcastObserver knows about one receiver
+type recipient struct {
+	joined    time.Time
+	completed int64 // bytes of the files it finished
+	current   int64 // bytes of the file in progress
+	status    string
+}
+
+// broadcastObserver follows a broadcast of total bytes: as JSON events, or
+// as a line per receiver that joins or finishes, under a status line with
+// the progress of each in fancy mode
+func broadcastObserver(recipients int, total int64) pulse.Observer {
+	if mode == modeJSON {
+		return jsonObserver()
+	}
+	states := make([]recipient, recipients)
+	for i := range states {
+		states[i].status = "waiting"
+	}
+	width := 0
+	erase := func() {
+		if width > 0 {
+			fmt.Fprintf(out, "\r%s\r", strings.Repeat(" ", width))
+			width = 0
+		}
+	}
+	draw := func() {
+		if mode != modeFancy {
+			return
+		}
+		parts := make([]string, len(states))
+		for i, st := range states {
+			status := st.status
+			if status == "sending" {
+				pct := 100.0
+				if total > 0 {
+					pct = float64(st.completed+st.current) / float64(total) * 100
+				}
+				status = fmt.Sprintf("%.0f%%", pct)
+			}
+			parts[i] = fmt.Sprintf("%d: %s", i+1, status)
+		}
+		line := "  " + strings.Join(parts, "  ")
+		erase()
+		fmt.Fprint(out, line)
+		width = utf8.RuneCountInString(line)
+	}
+	return pulse.ObserverFunc(func(e pulse.Event) {
+		re, ok := e.(pulse.RecipientEvent)
+		if !ok {
+			return
+		}
+		st := &states[re.Recipient]
+		n := re.Recipient + 1
+		switch e := re.Event.(type) {
+		case pulse.PeerJoinedEvent:
+			if !st.joined.IsZero() {
+				return
+			}
+			st.joined = time.Now()
+			st.status = "sending"
+			erase()
+			fmt.Fprintf(out, "  %sRecipient %d connected\n", icon("✓"), n)
+		case pulse.ProgressEvent:
+			st.current = e.Bytes
+		case pulse.FileEndEvent:
+			if e.Err == nil && e.Metadata.Size > 0 {
+				st.completed += e.Metadata.Size
+			}
+			st.current = 0
+		case pulse.RetryEvent:
+			erase()
+			fmt.Fprintf(out, "  %sRecipient %d retrying (%d/%d): %v\n", icon("↻"), n, e.Attempt, e.Max, e.Err)
+		case pulse.PhaseEvent:
+			if e.Phase != pulse.PhaseDone {
+				return
+			}
+			st.status = "done"
+			erase()
+			fmt.Fprintf(out, "  %sRecipient %d done (%s in %v)\n", icon("✓"), n, fmtBytes(st.completed), fmtDuration(time.Since(st.joined)))
+		case pulse.ErrorEvent:
+			st.status = "failed"
+			erase()
+			fmt.Fprintf(out, "  %sRecipient %d failed: %v\n", icon("✗"), n, e.Err)
+		}
+		draw()
+	})
+}
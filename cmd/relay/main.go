@@ -2,11 +2,15 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,88 +23,258 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// maxRecipients bounds the receivers of a broadcast room
+const maxRecipients = 32
+
+const (
+	// maxReserved bounds the nameplates handed out that nobody joined yet
+	maxReserved = 1000
+	// reservationTTL frees nameplates nobody joined. Whoever asks for one
+	// joins it right away.
+	reservationTTL = time.Minute
+)
+
+const (
+	// pingPeriod is how often the relay pings its clients, whose pongs show
+	// they are still there
+	pingPeriod = 20 * time.Second
+	// staleAfter is how long a client may stay silent before someone
+	// joining the room can take its place, as a peer reconnecting after
+	// its old connection dropped without closing
+	staleAfter = 2*pingPeriod + 5*time.Second
+)
+
+// Room pairs its clients and forwards messages within each pair. A plain
+// room holds two clients. A broadcast sender joins with one connection per
+// recipient, its lanes, and each receiver is paired with a lane of its own.
 type Room struct {
-	token     string
-	clients   []*websocket.Conn
-	mu        sync.Mutex
-	createdAt time.Time
+	token      string
+	clients    []*client
+	recipients int // receivers of a broadcast room, 0 for plain rooms
+	mu         sync.Mutex
+	createdAt  time.Time
+}
+
+type client struct {
+	conn *websocket.Conn
+	lane bool // a connection of a broadcast sender
+	peer *client
+	// lastSeen is when the client last sent anything, pongs included, in
+	// unix nanoseconds
+	lastSeen atomic.Int64
+	// writeMu serializes writes, which gorilla does not allow concurrently
+	writeMu sync.Mutex
 }
 
 type RoomManager struct {
-	rooms map[string]*Room
-	mu    sync.RWMutex
+	rooms    map[string]*Room
+	reserved map[string]*Room // nameplates nobody joined yet
+	mu       sync.RWMutex
 }
 
 func NewRoomManager() *RoomManager {
-	rm := &RoomManager{rooms: make(map[string]*Room)}
+	rm := &RoomManager{rooms: make(map[string]*Room), reserved: make(map[string]*Room)}
 	go rm.cleanupLoop()
 	return rm
 }
 
-func (rm *RoomManager) GetOrCreateRoom(token string) *Room {
+// Join adds conn to the room of token, which is created if needed. It
+// holds the manager's lock, so the room cannot be deleted in between.
+func (rm *RoomManager) Join(token string, conn *websocket.Conn, recipients int) (*Room, *client, bool) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
-	if room, exists := rm.rooms[token]; exists {
-		return room
+	room, exists := rm.rooms[token]
+	if !exists {
+		room = &Room{token: token, clients: make([]*client, 0, 2), createdAt: time.Now()}
+		rm.rooms[token] = room
 	}
-	room := &Room{token: token, clients: make([]*websocket.Conn, 0, 2), createdAt: time.Now()}
-	rm.rooms[token] = room
-	return room
+	delete(rm.reserved, token)
+	c, ok := room.AddClient(conn, recipients)
+	return room, c, ok
 }
 
-func (rm *RoomManager) DeleteRoom(token string) {
+// ReserveNameplate reserves the smallest number no room uses yet, for the
+// short codes that start with it. Once joined, the room is freed like any
+// other.
+func (rm *RoomManager) ReserveNameplate() (string, error) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
-	delete(rm.rooms, token)
+	rm.expireReservations()
+	if len(rm.reserved) >= maxReserved {
+		return "", errors.New("too many codes waiting, try again later")
+	}
+	for n := 1; ; n++ {
+		token := strconv.Itoa(n)
+		if _, exists := rm.rooms[token]; !exists {
+			room := &Room{token: token, clients: make([]*client, 0, 2), createdAt: time.Now()}
+			rm.rooms[token] = room
+			rm.reserved[token] = room
+			return token, nil
+		}
+	}
+}
+
+// expireReservations frees the nameplates nobody joined in time. The
+// caller holds the manager's lock.
+func (rm *RoomManager) expireReservations() {
+	for token, room := range rm.reserved {
+		if time.Since(room.createdAt) < reservationTTL {
+			continue
+		}
+		delete(rm.reserved, token)
+		if rm.rooms[token] == room {
+			delete(rm.rooms, token)
+		}
+	}
+}
+
+// Leave removes c from room and deletes the room once it is empty, which
+// frees its nameplate too
+func (rm *RoomManager) Leave(room *Room, c *client) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	room.RemoveClient(c)
+	room.mu.Lock()
+	isEmpty := len(room.clients) == 0
+	room.mu.Unlock()
+	if isEmpty && rm.rooms[room.token] == room {
+		delete(rm.rooms, room.token)
+	}
 }
 
 func (rm *RoomManager) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for range ticker.C {
 		rm.mu.Lock()
+		rm.expireReservations()
 		for token, room := range rm.rooms {
 			if time.Since(room.createdAt) > 10*time.Minute {
 				room.mu.Lock()
-				for _, conn := range room.clients {
-					conn.Close()
+				for _, c := range room.clients {
+					c.conn.Close()
 				}
 				room.mu.Unlock()
 				delete(rm.rooms, token)
+				delete(rm.reserved, token)
 			}
 		}
 		rm.mu.Unlock()
 	}
 }
 
-func (room *Room) AddClient(conn *websocket.Conn) bool {
+func (c *client) seen() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (c *client) stale() bool {
+	return time.Since(time.Unix(0, c.lastSeen.Load())) > staleAfter
+}
+
+// AddClient joins conn to the room and pairs it with a waiting client.
+// recipients is set for the lanes of a broadcast sender. When the room is
+// full, a stale client of the same role is replaced.
+func (room *Room) AddClient(conn *websocket.Conn, recipients int) (*client, bool) {
 	room.mu.Lock()
 	defer room.mu.Unlock()
-	if len(room.clients) >= 2 {
+	c := &client{conn: conn, lane: recipients > 0}
+	c.seen()
+	if !room.admits(c, recipients) {
+		if !room.evictStale(c.lane) || !room.admits(c, recipients) {
+			return nil, false
+		}
+	}
+	room.clients = append(room.clients, c)
+	room.pair(c)
+	return c, true
+}
+
+// admits tells whether c fits in the room. The caller holds room.mu.
+func (room *Room) admits(c *client, recipients int) bool {
+	lanes := 0
+	for _, other := range room.clients {
+		if other.lane {
+			lanes++
+		}
+	}
+	receivers := len(room.clients) - lanes
+	switch {
+	case c.lane:
+		if room.recipients == 0 && lanes == 0 && receivers <= 1 {
+			room.recipients = recipients
+		}
+		return recipients == room.recipients && lanes < room.recipients
+	case room.recipients > 0:
+		return receivers < room.recipients
+	default:
+		return len(room.clients) < 2
+	}
+}
+
+// evictStale closes the client that has been silent the longest, if it is
+// stale. Only clients of the given role are considered in broadcast rooms.
+// The caller holds room.mu.
+func (room *Room) evictStale(lane bool) bool {
+	var oldest *client
+	for _, other := range room.clients {
+		if room.recipients > 0 && other.lane != lane {
+			continue
+		}
+		if other.stale() && (oldest == nil || other.lastSeen.Load() < oldest.lastSeen.Load()) {
+			oldest = other
+		}
+	}
+	if oldest == nil {
 		return false
 	}
-	room.clients = append(room.clients, conn)
+	room.removeLocked(oldest)
+	if oldest.conn != nil {
+		oldest.conn.Close()
+	}
 	return true
 }
 
-func (room *Room) RemoveClient(conn *websocket.Conn) {
+// pair matches c with a client that has no peer yet: a receiver with a
+// lane in broadcast rooms, any other client in plain ones. Whoever joins
+// last announces itself, so pairs only form on joining.
+func (room *Room) pair(c *client) {
+	for _, other := range room.clients {
+		if other != c && other.peer == nil && (room.recipients == 0 || other.lane != c.lane) {
+			c.peer, other.peer = other, c
+			return
+		}
+	}
+}
+
+func (room *Room) RemoveClient(c *client) {
 	room.mu.Lock()
 	defer room.mu.Unlock()
-	for i, c := range room.clients {
-		if c == conn {
+	room.removeLocked(c)
+}
+
+func (room *Room) removeLocked(c *client) {
+	for i, other := range room.clients {
+		if other == c {
 			room.clients = append(room.clients[:i], room.clients[i+1:]...)
 			break
 		}
 	}
+	if c.peer != nil {
+		c.peer.peer = nil
+		c.peer = nil
+	}
 }
 
-func (room *Room) Broadcast(sender *websocket.Conn, message []byte) {
+// Forward passes a message to the peer of c, if it has one
+func (room *Room) Forward(c *client, message []byte) {
 	room.mu.Lock()
-	defer room.mu.Unlock()
-	for _, conn := range room.clients {
-		if conn != sender {
-			conn.WriteMessage(websocket.BinaryMessage, message)
-		}
+	peer := c.peer
+	room.mu.Unlock()
+	if peer == nil {
+		return
 	}
+	peer.writeMu.Lock()
+	defer peer.writeMu.Unlock()
+	peer.conn.WriteMessage(websocket.BinaryMessage, message)
 }
 
 var roomManager = NewRoomManager()
@@ -111,37 +285,70 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing token", http.StatusBadRequest)
 		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Broadcast senders join with one connection per recipient
+	var recipients int
+	var header http.Header
+	if value := r.URL.Query().Get("recipients"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxRecipients {
+			http.Error(w, "invalid recipients", http.StatusBadRequest)
+			return
+		}
+		recipients = n
+		// Tells the sender this relay pairs lanes, older ones do not
+		header = http.Header{"X-Pulse-Recipients": {value}}
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Printf("websocket upgrade failed: %v", err)
 		return
 	}
 	defer conn.Close()
 
-	room := roomManager.GetOrCreateRoom(token)
-	if !room.AddClient(conn) {
+	room, c, ok := roomManager.Join(token, conn, recipients)
+	if !ok {
 		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "room full"))
 		return
 	}
-	defer room.RemoveClient(conn)
 
 	log.Printf("client joined room %s", token)
 
+	conn.SetPongHandler(func(string) error {
+		c.seen()
+		return nil
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go keepAlive(conn, done)
+
 	for {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
 			break
 		}
+		c.seen()
 		if messageType == websocket.BinaryMessage {
-			room.Broadcast(conn, message)
+			room.Forward(c, message)
 		}
 	}
 
-	room.mu.Lock()
-	isEmpty := len(room.clients) == 0
-	room.mu.Unlock()
-	if isEmpty {
-		roomManager.DeleteRoom(token)
+	roomManager.Leave(room, c)
+}
+
+// keepAlive pings conn until done is closed or the ping cannot be sent.
+// WriteControl may run alongside the writes of Forward.
+func keepAlive(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingPeriod)); err != nil {
+				return
+			}
+		}
 	}
 }
 
@@ -177,6 +384,29 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	w.Write(content)
 }
 
+func handleNameplate(w http.ResponseWriter, r *http.Request) {
+	nameplate, err := roomManager.ReserveNameplate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"nameplate":%q}`, nameplate)
+}
+
+// handlePair serves the page where a paired phone waits for files. The
+// secrets live in the browser, so there is no token in the path.
+func handlePair(w http.ResponseWriter, r *http.Request) {
+	staticFS, _ := fs.Sub(staticFiles, "static")
+	content, err := fs.ReadFile(staticFS, "paired.html")
+	if err != nil {
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(content)
+}
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -186,6 +416,8 @@ func main() {
 	mux.HandleFunc("GET /ws/{token}", handleWebSocket)
 	mux.HandleFunc("GET /d/{token}", handleDownload)
 	mux.HandleFunc("GET /u/{token}", handleUpload)
+	mux.HandleFunc("GET /p/", handlePair)
+	mux.HandleFunc("POST /nameplates", handleNameplate)
 	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`{"status":"ok"}`))
 	})
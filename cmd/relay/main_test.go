@@ -0,0 +1,201 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// join adds a client without a connection, which the room never touches
+// unless it evicts the client
+func join(t *testing.T, room *Room, recipients int) *client {
+	t.Helper()
+	c, ok := room.AddClient(nil, recipients)
+	if !ok {
+		t.Fatalf("client with %d recipients was refused", recipients)
+	}
+	return c
+}
+
+func makeStale(c *client) {
+	c.lastSeen.Store(time.Now().Add(-2 * staleAfter).UnixNano())
+}
+
+func TestAddClientReplacesStale(t *testing.T) {
+	tests := []struct {
+		name       string
+		recipients int    // of the lanes, 0 for a plain room
+		stale      []bool // per client already in the room
+		lane       bool   // whether the newcomer is a lane
+		want       int    // index of the client replaced, -1 if refused
+	}{
+		{name: "plain room, both alive", stale: []bool{false, false}, want: -1},
+		{name: "plain room, first stale", stale: []bool{true, false}, want: 0},
+		{name: "plain room, second stale", stale: []bool{false, true}, want: 1},
+		{name: "broadcast, stale lane replaced by lane", recipients: 1, stale: []bool{true, false}, lane: true, want: 0},
+		{name: "broadcast, stale receiver kept for lane", recipients: 1, stale: []bool{false, true}, lane: true, want: -1},
+		{name: "broadcast, stale receiver replaced by receiver", recipients: 1, stale: []bool{false, true}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := &Room{token: "t"}
+			var clients []*client
+			for i := range tt.stale {
+				recipients := 0
+				if tt.recipients > 0 && i == 0 {
+					recipients = tt.recipients
+				}
+				clients = append(clients, join(t, room, recipients))
+			}
+			for i, stale := range tt.stale {
+				if stale {
+					makeStale(clients[i])
+				}
+			}
+
+			recipients := 0
+			if tt.lane {
+				recipients = tt.recipients
+			}
+			c, ok := room.AddClient(nil, recipients)
+			if tt.want < 0 {
+				if ok {
+					t.Fatal("newcomer was admitted")
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("newcomer was refused")
+			}
+			replaced := clients[tt.want]
+			kept := clients[1-tt.want]
+			if len(room.clients) != 2 {
+				t.Fatalf("room has %d clients, want 2", len(room.clients))
+			}
+			for _, other := range room.clients {
+				if other == replaced {
+					t.Fatal("stale client is still in the room")
+				}
+			}
+			if replaced.peer != nil {
+				t.Error("stale client is still paired")
+			}
+			if c.peer != kept || kept.peer != c {
+				t.Error("newcomer is not paired with the remaining client")
+			}
+		})
+	}
+}
+
+func TestAddClientPairs(t *testing.T) {
+	type step struct {
+		recipients int  // set for the lanes of a broadcast sender
+		leave      int  // instead of joining, the client that joined at this step leaves, 1-based
+		refused    bool // the room is full for this client
+		peer       int  // step whose client this one is paired with, 1-based, 0 for none
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "plain room",
+			steps: []step{{}, {peer: 1}, {refused: true}},
+		},
+		{
+			name:  "plain room frees a place",
+			steps: []step{{}, {peer: 1}, {leave: 1}, {peer: 2}},
+		},
+		{
+			name: "lanes first",
+			steps: []step{
+				{recipients: 2}, {recipients: 2},
+				{peer: 1}, {peer: 2}, {refused: true},
+			},
+		},
+		{
+			name: "receiver first",
+			steps: []step{
+				{}, {recipients: 2, peer: 1}, {recipients: 2},
+				{peer: 3}, {refused: true},
+			},
+		},
+		{
+			name: "lanes are never paired with each other",
+			steps: []step{
+				{recipients: 3}, {recipients: 3}, {recipients: 3}, {recipients: 3, refused: true},
+			},
+		},
+		{
+			name:  "lanes must agree on the recipients",
+			steps: []step{{recipients: 2}, {recipients: 3, refused: true}},
+		},
+		{
+			name:  "no lanes in a full plain room",
+			steps: []step{{}, {peer: 1}, {recipients: 1, refused: true}},
+		},
+		{
+			name: "receiver that left frees its lane",
+			steps: []step{
+				{recipients: 2}, {recipients: 2},
+				{peer: 1}, {peer: 2}, {leave: 3}, {peer: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := &Room{token: "t"}
+			clients := make([]*client, len(tt.steps))
+			for i, s := range tt.steps {
+				if s.leave > 0 {
+					room.RemoveClient(clients[s.leave-1])
+					continue
+				}
+				c, ok := room.AddClient(nil, s.recipients)
+				if ok == s.refused {
+					t.Fatalf("step %d: admitted = %v, want %v", i+1, ok, !s.refused)
+				}
+				clients[i] = c
+				if !ok {
+					continue
+				}
+				var want *client
+				if s.peer > 0 {
+					want = clients[s.peer-1]
+				}
+				if c.peer != want {
+					t.Errorf("step %d: paired with the wrong client", i+1)
+				}
+				if want != nil && want.peer != c {
+					t.Errorf("step %d: pairing is one-sided", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	rm := &RoomManager{rooms: make(map[string]*Room), reserved: make(map[string]*Room)}
+	token, err := rm.ReserveNameplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	room, first, ok := rm.Join(token, nil, 0)
+	if !ok {
+		t.Fatal("first client was refused")
+	}
+	if _, reserved := rm.reserved[token]; reserved {
+		t.Error("joined nameplate is still reserved")
+	}
+	_, second, ok := rm.Join(token, nil, 0)
+	if !ok || second.peer != first {
+		t.Fatal("second client was not paired")
+	}
+	rm.Leave(room, first)
+	if rm.rooms[token] != room {
+		t.Fatal("room was deleted while a client is left")
+	}
+	rm.Leave(room, second)
+	if _, exists := rm.rooms[token]; exists {
+		t.Error("empty room was kept")
+	}
+}
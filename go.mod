@@ -6,9 +6,8 @@ require (
 	github.com/gorilla/websocket v1.5.1
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/text v0.14.0
 )
 
-require (
-	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
-)
+require golang.org/x/net v0.17.0 // indirect
@@ -0,0 +1,198 @@
+// Package codes connects two terminals with a short code such as
+// 7-purple-sausage instead of a link.
+//
+// The number, the nameplate, is handed out by the relay and names a room
+// where both sides run a SPAKE2 exchange with the whole code as password.
+// The key it yields seals the transfer and names the room it moves to, so
+// the relay, which sees only the nameplate, cannot test guesses of the
+// words offline. Someone guessing online gets one try, after which both
+// sides give up.
+package codes
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/fromjyce/pulse/internal/spake2"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Words is how many words follow the nameplate. Two of 256 leave one
+// chance in 65536 to guess a code.
+const Words = 2
+
+// ErrWrongCode means the other side typed another code, or someone tried
+// to guess it
+var ErrWrongCode = errors.New("the code does not match, check it and start over with a new one")
+
+// Generate makes a code from a nameplate and random words
+func Generate(nameplate string) (string, error) {
+	parts := []string{nameplate}
+	for i := 0; i < Words; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, words[n.Int64()])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// Parse normalizes a typed code and returns it with its nameplate
+func Parse(code string) (string, string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.Join(strings.Fields(strings.ReplaceAll(code, "-", " ")), "-")
+	parts := strings.Split(code, "-")
+	if len(parts) != Words+1 {
+		return "", "", fmt.Errorf("invalid code %q, it looks like 7-purple-sausage", code)
+	}
+	if n, err := strconv.Atoi(parts[0]); err != nil || n < 1 {
+		return "", "", fmt.Errorf("invalid code %q, it starts with a number", code)
+	}
+	for _, word := range parts[1:] {
+		if !isWord(word) {
+			return "", "", fmt.Errorf("invalid code %q, %q is not one of its words", code, word)
+		}
+	}
+	return code, parts[0], nil
+}
+
+func isWord(s string) bool {
+	for _, w := range words {
+		if w == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Allocate asks the relay for a nameplate nobody else is using
+func Allocate(ctx context.Context, relay string) (string, error) {
+	httpRelay := strings.Replace(strings.Replace(relay, "wss://", "https://", 1), "ws://", "http://", 1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, httpRelay+"/nameplates", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach relay: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return "", errors.New("the relay does not hand out codes, it needs to be updated")
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return "", errors.New("the relay has too many codes waiting, try again in a minute")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get a code from the relay: %s", resp.Status)
+	}
+	var answer struct {
+		Nameplate string `json:"nameplate"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024)).Decode(&answer); err != nil || answer.Nameplate == "" {
+		return "", errors.New("failed to get a code from the relay: invalid answer")
+	}
+	return answer.Nameplate, nil
+}
+
+// message is what both sides say in the nameplate room. The exchange
+// messages are public by design, confirmations prove the key.
+type message struct {
+	Type string `json:"type"` // "pake" or "confirm"
+	Data []byte `json:"data"`
+}
+
+// Exchange runs the key exchange for code with the other side in the
+// nameplate room. The sender takes one role, the receiver the other. It
+// returns the room and key of the transfer.
+func Exchange(ctx context.Context, relay, code string, sender bool) (string, []byte, error) {
+	code, nameplate, err := Parse(code)
+	if err != nil {
+		return "", nil, err
+	}
+	role := spake2.RoleB
+	if sender {
+		role = spake2.RoleA
+	}
+	exchange, err := spake2.New(role, []byte(code))
+	if err != nil {
+		return "", nil, err
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, fmt.Sprintf("%s/ws/%s", relay, nameplate), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	say := func(m message) error {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	// The relay drops what arrives before the other side joins, so our
+	// message goes out again once theirs arrives
+	if err := say(message{Type: "pake", Data: exchange.Message()}); err != nil {
+		return "", nil, fmt.Errorf("failed to send key exchange: %w", err)
+	}
+	var shared []byte
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", nil, fmt.Errorf("timeout waiting for the other side to enter the code: %w", ctx.Err())
+			}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Text == "room full" {
+				return "", nil, errors.New("the code is in use by someone else")
+			}
+			return "", nil, fmt.Errorf("failed to exchange keys: %w", err)
+		}
+		var m message
+		if err := json.Unmarshal(data, &m); err != nil {
+			continue
+		}
+		switch {
+		case m.Type == "pake" && shared == nil:
+			if err := say(message{Type: "pake", Data: exchange.Message()}); err != nil {
+				return "", nil, fmt.Errorf("failed to send key exchange: %w", err)
+			}
+			if shared, err = exchange.Finish(m.Data); err != nil {
+				return "", nil, err
+			}
+			if err := say(message{Type: "confirm", Data: exchange.Confirmation()}); err != nil {
+				return "", nil, fmt.Errorf("failed to send key exchange: %w", err)
+			}
+		case m.Type == "confirm" && shared != nil:
+			if !exchange.Verify(m.Data) {
+				return "", nil, ErrWrongCode
+			}
+			token, key := derive(shared)
+			return token, key, nil
+		}
+	}
+}
+
+// derive splits the shared key into the room and key of the transfer
+func derive(shared []byte) (string, []byte) {
+	out := make([]byte, 16+crypto.KeySize)
+	io.ReadFull(hkdf.New(sha256.New, shared, nil, []byte("pulse code session")), out)
+	return hex.EncodeToString(out[:16]), out[16:]
+}
@@ -0,0 +1,38 @@
+package codes
+
+// words are the 256 words codes are made of: short, common and easy to
+// spell out loud
+var words = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "album", "alpine", "amber",
+	"anchor", "angel", "apple", "apron", "arcade", "arrow", "atlas", "attic",
+	"autumn", "avocado", "badge", "bagel", "bakery", "balloon", "bamboo", "banana",
+	"banjo", "barrel", "basket", "beacon", "beaver", "bicycle", "biscuit", "blanket",
+	"blossom", "bonfire", "bottle", "breeze", "bridge", "bronze", "bubble", "bucket",
+	"buffalo", "bugle", "butter", "cabin", "cactus", "camel", "candle", "canoe",
+	"canyon", "carbon", "carpet", "carrot", "castle", "cedar", "cello", "cherry",
+	"chimney", "cider", "circus", "clover", "cobalt", "coconut", "comet", "copper",
+	"coral", "cotton", "cougar", "crayon", "cricket", "crystal", "cupcake", "dahlia",
+	"daisy", "desert", "diamond", "dolphin", "domino", "donkey", "dragon", "drum",
+	"eagle", "easel", "echo", "eclipse", "elbow", "ember", "emerald", "engine",
+	"falcon", "feather", "fennel", "ferret", "fiddle", "fig", "flamingo", "fossil",
+	"fountain", "fox", "galaxy", "garden", "garlic", "gecko", "ginger", "giraffe",
+	"glacier", "goblet", "gopher", "granite", "grape", "gravel", "guitar", "hammock",
+	"harbor", "harvest", "hazel", "helmet", "heron", "hickory", "honey", "horizon",
+	"husky", "igloo", "iguana", "indigo", "iris", "island", "ivory", "jacket",
+	"jaguar", "jasmine", "jelly", "jigsaw", "jungle", "kayak", "kettle", "kiwi",
+	"koala", "ladder", "lagoon", "lantern", "lemon", "lentil", "library", "lilac",
+	"lizard", "lobster", "locket", "lotus", "magnet", "mango", "maple", "marble",
+	"meadow", "melon", "meteor", "mint", "mitten", "monkey", "mosaic", "muffin",
+	"mustard", "nectar", "nickel", "noodle", "nutmeg", "oasis", "ocean", "olive",
+	"onion", "orange", "orchid", "otter", "owl", "paddle", "pancake", "panda",
+	"papaya", "parrot", "peanut", "pebble", "pelican", "pepper", "piano", "pickle",
+	"pigeon", "pillow", "pine", "pirate", "pizza", "planet", "plum", "pocket",
+	"pony", "poppy", "potato", "pretzel", "puffin", "pumpkin", "purple", "quartz",
+	"quill", "rabbit", "radish", "rainbow", "raven", "ribbon", "river", "robin",
+	"rocket", "saddle", "saffron", "salmon", "sandal", "sapphire", "sausage", "scarf",
+	"seagull", "shadow", "silver", "sketch", "sparrow", "spider", "sponge", "squirrel",
+	"stamp", "starfish", "stone", "sugar", "summit", "sunset", "swan", "tangerine",
+	"teapot", "thimble", "thunder", "tiger", "toast", "tomato", "topaz", "tornado",
+	"tractor", "trumpet", "tulip", "tunnel", "turkey", "turtle", "umbrella", "unicorn",
+	"valley", "velvet", "violet", "violin", "volcano", "waffle", "walnut", "walrus",
+}
@@ -4,8 +4,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
 
 	"golang.org/x/crypto/nacl/secretbox"
@@ -87,3 +89,144 @@ func ComputeChecksum(data []byte) string {
 	hash := sha256.Sum256(data)
 	return hex.EncodeToString(hash[:])
 }
+
+// Hasher computes a SHA256 checksum incrementally, so large files never
+// need to be held in memory
+type Hasher struct {
+	h hash.Hash
+}
+
+func NewHasher() *Hasher {
+	return &Hasher{h: sha256.New()}
+}
+
+// Write feeds data into the running checksum. It never returns an error.
+func (h *Hasher) Write(p []byte) (int, error) {
+	return h.h.Write(p)
+}
+
+// Sum returns the hex checksum of everything written so far
+func (h *Hasher) Sum() string {
+	return hex.EncodeToString(h.h.Sum(nil))
+}
+
+// ComputeChecksumReader streams r through SHA256 and returns the hex string
+func ComputeChecksumReader(r io.Reader) (string, error) {
+	h := NewHasher()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return h.Sum(), nil
+}
+
+// Directions a sealed message can travel in. They are part of every nonce,
+// so a relay cannot reflect a message back to the peer that sealed it.
+const (
+	DirectionToReceiver byte = 'S'
+	DirectionToSender   byte = 'R'
+)
+
+var (
+	ErrWrongDirection = errors.New("message sealed for the other direction")
+	ErrOutOfOrder     = errors.New("message out of order, replayed or dropped")
+)
+
+const epochSize = 15
+
+// Sealer encrypts an ordered stream of messages. Nonces are built STREAM
+// style from the direction, a random epoch ID and a 64-bit counter, so every
+// ciphertext is bound to its position. A Sealer is not safe for concurrent
+// use.
+type Sealer struct {
+	key       [KeySize]byte
+	direction byte
+	epoch     [epochSize]byte
+	counter   uint64
+}
+
+// NewSealer starts a new epoch, whose first message is counter 0
+func NewSealer(key []byte, direction byte) (*Sealer, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("invalid key size")
+	}
+	s := &Sealer{direction: direction}
+	copy(s.key[:], key)
+	if _, err := io.ReadFull(rand.Reader, s.epoch[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sealer) Seal(plaintext []byte) ([]byte, error) {
+	var nonce [NonceSize]byte
+	nonce[0] = s.direction
+	copy(nonce[1:1+epochSize], s.epoch[:])
+	binary.BigEndian.PutUint64(nonce[1+epochSize:], s.counter)
+	s.counter++
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &s.key), nil
+}
+
+// Opener decrypts messages from a Sealer and rejects anything that is not
+// the next message in sequence. A peer that reconnects starts a new epoch,
+// which is only accepted at counter 0 and only once, so earlier epochs cannot
+// be replayed.
+type Opener struct {
+	key       [KeySize]byte
+	direction byte
+	epoch     [epochSize]byte
+	next      uint64
+	started   bool
+	seen      map[[epochSize]byte]bool
+}
+
+// NewOpener accepts messages sealed for the given direction
+func NewOpener(key []byte, direction byte) (*Opener, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("invalid key size")
+	}
+	o := &Opener{direction: direction, seen: make(map[[epochSize]byte]bool)}
+	copy(o.key[:], key)
+	return o, nil
+}
+
+// Open returns the plaintext and whether the message started a new epoch
+func (o *Opener) Open(ciphertext []byte) ([]byte, bool, error) {
+	if len(ciphertext) < NonceSize {
+		return nil, false, errors.New("ciphertext too short")
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], ciphertext[:NonceSize])
+	if nonce[0] != o.direction {
+		return nil, false, ErrWrongDirection
+	}
+	var epoch [epochSize]byte
+	copy(epoch[:], nonce[1:1+epochSize])
+	counter := binary.BigEndian.Uint64(nonce[1+epochSize:])
+	newEpoch := !o.started || epoch != o.epoch
+	if (newEpoch && (counter != 0 || o.seen[epoch])) || (!newEpoch && counter != o.next) {
+		return nil, false, ErrOutOfOrder
+	}
+	plaintext, ok := secretbox.Open(nil, ciphertext[NonceSize:], &nonce, &o.key)
+	if !ok {
+		return nil, false, errors.New("decryption failed")
+	}
+	if newEpoch {
+		o.epoch = epoch
+		o.seen[epoch] = true
+		o.started = true
+	}
+	o.next = counter + 1
+	return plaintext, newEpoch, nil
+}
+
+// IsUnsequenced reports whether ciphertext is a valid message sealed with a
+// random nonce by EncryptChunk, as releases before sequenced nonces did
+func (o *Opener) IsUnsequenced(ciphertext []byte) bool {
+	if len(ciphertext) < NonceSize || ciphertext[0] == DirectionToReceiver || ciphertext[0] == DirectionToSender {
+		return false
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], ciphertext[:NonceSize])
+	_, ok := secretbox.Open(nil, ciphertext[NonceSize:], &nonce, &o.key)
+	return ok
+}
@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOpener(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(s *Sealer, n int) [][]byte {
+		frames := make([][]byte, n)
+		for i := range frames {
+			frame, err := s.Seal([]byte{byte(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames[i] = frame
+		}
+		return frames
+	}
+	newSealer := func(direction byte) *Sealer {
+		s, err := NewSealer(key, direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	// Two epochs of the sender, as before and after a reconnect, and one
+	// message sealed by the receiver
+	a := seal(newSealer(DirectionToReceiver), 3)
+	b := seal(newSealer(DirectionToReceiver), 2)
+	reflected := seal(newSealer(DirectionToSender), 1)[0]
+
+	tampered := append([]byte(nil), a[0]...)
+	tampered[len(tampered)-1] ^= 1
+
+	errDecrypt := errors.New("any error")
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []error
+	}{
+		{"in order", [][]byte{a[0], a[1], a[2]}, []error{nil, nil, nil}},
+		{"new epoch", [][]byte{a[0], a[1], b[0], b[1]}, []error{nil, nil, nil, nil}},
+		{"reordered", [][]byte{a[0], a[2], a[1]}, []error{nil, ErrOutOfOrder, nil}},
+		{"duplicated", [][]byte{a[0], a[1], a[1]}, []error{nil, nil, ErrOutOfOrder}},
+		{"duplicated first", [][]byte{a[0], a[0]}, []error{nil, ErrOutOfOrder}},
+		{"epoch not starting at 0", [][]byte{a[1]}, []error{ErrOutOfOrder}},
+		{"old epoch continued", [][]byte{a[0], b[0], a[1]}, []error{nil, nil, ErrOutOfOrder}},
+		{"replayed epoch", [][]byte{a[0], a[1], b[0], a[0]}, []error{nil, nil, nil, ErrOutOfOrder}},
+		{"replayed epoch after rejection", [][]byte{a[0], b[0], a[0], a[0]}, []error{nil, nil, ErrOutOfOrder, ErrOutOfOrder}},
+		{"reflected", [][]byte{reflected}, []error{ErrWrongDirection}},
+		{"tampered", [][]byte{tampered, a[0]}, []error{errDecrypt, nil}},
+		{"truncated", [][]byte{a[0][:len(a[0])-1], a[0]}, []error{errDecrypt, nil}},
+		{"too short", [][]byte{a[0][:NonceSize-1]}, []error{errDecrypt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOpener(key, DirectionToReceiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, frame := range tt.frames {
+				_, _, err := o.Open(frame)
+				switch want := tt.want[i]; {
+				case want == errDecrypt:
+					if err == nil {
+						t.Errorf("frame %d: opened, want an error", i)
+					}
+				case want == nil && err != nil:
+					t.Errorf("frame %d: %v", i, err)
+				case !errors.Is(err, want):
+					t.Errorf("frame %d: got %v, want %v", i, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenerReportsNewEpochs(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewOpener(key, DirectionToReceiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for epoch := 0; epoch < 2; epoch++ {
+		s, err := NewSealer(key, DirectionToReceiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			frame, err := s.Seal([]byte("message"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, newEpoch, err := o.Open(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plain) != "message" {
+				t.Errorf("got %q, want %q", plain, "message")
+			}
+			if newEpoch != (i == 0) {
+				t.Errorf("epoch %d message %d: new epoch = %v", epoch, i, newEpoch)
+			}
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package delta computes rsync-style differences between a file the receiver
+// already has, the base, and a new version of it. The receiver describes the
+// base with a signature of its blocks; the sender matches those blocks
+// anywhere in the new file and only sends what did not match.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	MinBlockSize = 1024
+	// MaxBlocks bounds the size of a signature, larger files get larger
+	// blocks
+	MaxBlocks = 1 << 15
+	// StrongSize is how many bytes of the SHA-256 of a block are kept
+	StrongSize = 16
+)
+
+// Block describes one block of the base
+type Block struct {
+	Weak   uint32 `json:"weak"`   // rolling checksum
+	Strong []byte `json:"strong"` // truncated SHA-256
+}
+
+// Signature describes a base in blocks of BlockSize bytes, the last one may
+// be shorter
+type Signature struct {
+	BlockSize int     `json:"block_size"`
+	Size      int64   `json:"size"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// Op is one instruction for rebuilding the new file: literal data, or when
+// Data is nil, Blocks blocks of the base starting at Block
+type Op struct {
+	Data   []byte
+	Block  int
+	Blocks int
+}
+
+// BlockSizeFor picks a block size for a base of the given size: about the
+// square root, as rsync does
+func BlockSizeFor(size int64) int {
+	blockSize := int64(math.Sqrt(float64(size)))
+	if blockSize < MinBlockSize {
+		blockSize = MinBlockSize
+	}
+	if least := (size + MaxBlocks - 1) / MaxBlocks; blockSize < least {
+		blockSize = least
+	}
+	return int(blockSize)
+}
+
+// Sign reads the base and returns its signature
+func Sign(r io.Reader, blockSize int) (Signature, error) {
+	if blockSize <= 0 {
+		return Signature{}, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	sig := Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: newRolling(buf[:n]).sum(), Strong: strongSum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return Signature{}, err
+		}
+	}
+}
+
+// Validate checks that the signature is consistent, so a malformed one
+// from the other side cannot derail Diff or Range
+func (s Signature) Validate() error {
+	if s.BlockSize <= 0 || s.Size < 0 {
+		return errors.New("invalid signature")
+	}
+	if int64(len(s.Blocks)) != (s.Size+int64(s.BlockSize)-1)/int64(s.BlockSize) {
+		return fmt.Errorf("signature has %d blocks for %d bytes", len(s.Blocks), s.Size)
+	}
+	for _, block := range s.Blocks {
+		if len(block.Strong) != StrongSize {
+			return errors.New("invalid block checksum in signature")
+		}
+	}
+	return nil
+}
+
+// Range returns where count blocks starting at block lie in the base
+func (s Signature) Range(block, count int) (offset, length int64, err error) {
+	if block < 0 || count <= 0 || count > len(s.Blocks)-block {
+		return 0, 0, fmt.Errorf("blocks %d+%d are outside the base", block, count)
+	}
+	offset = int64(block) * int64(s.BlockSize)
+	end := offset + int64(count)*int64(s.BlockSize)
+	if end > s.Size {
+		end = s.Size
+	}
+	return offset, end - offset, nil
+}
+
+// Diff reads the new file from r and calls emit with the instructions that
+// rebuild it from the base. Literal ops carry at most maxLiteral bytes, and
+// their Data is only valid until emit returns.
+func Diff(sig Signature, r io.Reader, maxLiteral int, emit func(Op) error) error {
+	if err := sig.Validate(); err != nil {
+		return err
+	}
+	if maxLiteral <= 0 {
+		return fmt.Errorf("invalid literal size %d", maxLiteral)
+	}
+	d := &differ{sig: sig, index: make(map[uint32][]int, len(sig.Blocks)), maxLiteral: maxLiteral, emit: emit}
+	for i, block := range sig.Blocks {
+		d.index[block.Weak] = append(d.index[block.Weak], i)
+	}
+
+	bs := sig.BlockSize
+	// buf holds the data from start, the first byte not emitted yet. A
+	// pending literal never exceeds maxLiteral, so compacting always frees
+	// at least maxLiteral+bs bytes for reading.
+	buf := make([]byte, 0, 2*(maxLiteral+bs+1))
+	start, pos := 0, 0
+	eof := false
+	var roll rolling
+	fresh := true
+	for {
+		// Keep the window and the byte after it in the buffer
+		for !eof && len(buf)-pos <= bs {
+			if start > 0 {
+				n := copy(buf, buf[start:])
+				buf = buf[:n]
+				pos -= start
+				start = 0
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(buf)-pos < bs {
+			// Only the base's last block can match a short tail
+			if block, ok := d.match(buf[pos:], newRolling(buf[pos:]).sum()); ok {
+				if err := d.literal(buf[start:pos]); err != nil {
+					return err
+				}
+				if err := d.copyBlock(block); err != nil {
+					return err
+				}
+				return d.flush()
+			}
+			if err := d.literal(buf[start:]); err != nil {
+				return err
+			}
+			return d.flush()
+		}
+
+		window := buf[pos : pos+bs]
+		if fresh {
+			roll = newRolling(window)
+			fresh = false
+		}
+		if block, ok := d.match(window, roll.sum()); ok {
+			if err := d.literal(buf[start:pos]); err != nil {
+				return err
+			}
+			if err := d.copyBlock(block); err != nil {
+				return err
+			}
+			pos += bs
+			start = pos
+			fresh = true
+			continue
+		}
+
+		if pos-start >= maxLiteral {
+			if err := d.literal(buf[start:pos]); err != nil {
+				return err
+			}
+			start = pos
+		}
+		if pos+bs == len(buf) {
+			// End of input right after an unmatched full window
+			if err := d.literal(buf[start:]); err != nil {
+				return err
+			}
+			return d.flush()
+		}
+		roll.roll(buf[pos], buf[pos+bs])
+		pos++
+	}
+}
+
+// differ collects the ops of Diff, merging copies of consecutive blocks
+type differ struct {
+	sig        Signature
+	index      map[uint32][]int // weak checksum -> blocks
+	maxLiteral int
+	emit       func(Op) error
+
+	copyFrom, copyCount int // pending copy
+}
+
+// match finds a block of the base equal to data, preferring the one right
+// after the previous copy
+func (d *differ) match(data []byte, weak uint32) (int, bool) {
+	candidates := d.index[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	var strong []byte
+	found := -1
+	for _, block := range candidates {
+		_, length, _ := d.sig.Range(block, 1)
+		if length != int64(len(data)) {
+			continue
+		}
+		if strong == nil {
+			strong = strongSum(data)
+		}
+		if !bytes.Equal(strong, d.sig.Blocks[block].Strong) {
+			continue
+		}
+		if d.copyCount > 0 && block == d.copyFrom+d.copyCount {
+			return block, true
+		}
+		if found < 0 {
+			found = block
+		}
+	}
+	return found, found >= 0
+}
+
+func (d *differ) copyBlock(block int) error {
+	if d.copyCount > 0 && block == d.copyFrom+d.copyCount {
+		d.copyCount++
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.copyFrom, d.copyCount = block, 1
+	return nil
+}
+
+func (d *differ) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > d.maxLiteral {
+			n = d.maxLiteral
+		}
+		if err := d.emit(Op{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// flush emits the pending copy
+func (d *differ) flush() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+	op := Op{Block: d.copyFrom, Blocks: d.copyCount}
+	d.copyCount = 0
+	return d.emit(op)
+}
+
+// rolling is the rsync weak checksum, which can slide over the data one
+// byte at a time
+type rolling struct {
+	a, b, n uint32
+}
+
+func newRolling(data []byte) rolling {
+	r := rolling{n: uint32(len(data))}
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+// roll drops out from the front of the window and appends in
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strongSum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:StrongSize]
+}
@@ -0,0 +1,142 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// rebuild applies the ops of a diff to base
+func rebuild(t *testing.T, sig Signature, base []byte, ops []Op) []byte {
+	t.Helper()
+	var out []byte
+	for _, op := range ops {
+		if op.Data != nil {
+			out = append(out, op.Data...)
+			continue
+		}
+		offset, length, err := sig.Range(op.Block, op.Blocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, base[offset:offset+length]...)
+	}
+	return out
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// randomEdits inserts, deletes and replaces random runs of data
+func randomEdits(r *rand.Rand, base []byte) []byte {
+	out := append([]byte(nil), base...)
+	for i := 0; i < 1+r.Intn(20); i++ {
+		at := 0
+		if len(out) > 0 {
+			at = r.Intn(len(out))
+		}
+		n := 1 + r.Intn(3000)
+		switch r.Intn(3) {
+		case 0:
+			out = append(out[:at], append(randomBytes(r, n), out[at:]...)...)
+		case 1:
+			out = append(out[:at], out[min(at+n, len(out)):]...)
+		default:
+			copy(out[at:], randomBytes(r, n))
+		}
+	}
+	return out
+}
+
+func TestDiffRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		edit func(r *rand.Rand, base []byte) []byte
+	}{
+		{"identical", 100000, func(r *rand.Rand, base []byte) []byte { return base }},
+		{"empty base", 0, func(r *rand.Rand, base []byte) []byte { return randomBytes(r, 5000) }},
+		{"emptied", 5000, func(r *rand.Rand, base []byte) []byte { return nil }},
+		{"both empty", 0, func(r *rand.Rand, base []byte) []byte { return nil }},
+		{"one byte changed", 100000, func(r *rand.Rand, base []byte) []byte {
+			out := append([]byte(nil), base...)
+			out[r.Intn(len(out))]++
+			return out
+		}},
+		{"prepended", 100000, func(r *rand.Rand, base []byte) []byte {
+			return append(randomBytes(r, 1+r.Intn(100)), base...)
+		}},
+		{"appended", 100000, func(r *rand.Rand, base []byte) []byte {
+			return append(append([]byte(nil), base...), randomBytes(r, 1+r.Intn(5000))...)
+		}},
+		{"truncated", 100000, func(r *rand.Rand, base []byte) []byte { return base[:r.Intn(len(base))] }},
+		{"blocks swapped", 100000, func(r *rand.Rand, base []byte) []byte {
+			half := len(base) / 2
+			return append(append([]byte(nil), base[half:]...), base[:half]...)
+		}},
+		{"unrelated", 50000, func(r *rand.Rand, base []byte) []byte { return randomBytes(r, 60000) }},
+		{"random edits", 300000, randomEdits},
+		{"random edits to a small file", 700, randomEdits},
+	}
+	const maxLiteral = 4096
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for seed := int64(1); seed <= 5; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				base := randomBytes(r, tt.size)
+				target := tt.edit(r, base)
+
+				sig, err := Sign(bytes.NewReader(base), BlockSizeFor(int64(len(base))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var ops []Op
+				var literal int
+				err = Diff(sig, bytes.NewReader(target), maxLiteral, func(op Op) error {
+					if op.Data != nil {
+						if len(op.Data) > maxLiteral {
+							t.Errorf("seed %d: literal of %d bytes exceeds %d", seed, len(op.Data), maxLiteral)
+						}
+						literal += len(op.Data)
+						// Data is only valid during the call
+						op.Data = append([]byte{}, op.Data...)
+					}
+					ops = append(ops, op)
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+				if got := rebuild(t, sig, base, ops); !bytes.Equal(got, target) {
+					t.Fatalf("seed %d: rebuilt %d bytes that differ from the %d expected", seed, len(got), len(target))
+				}
+				if tt.name == "identical" && literal != 0 {
+					t.Errorf("seed %d: sent %d literal bytes for an identical file", seed, literal)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffRejectsInvalidSignature(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  Signature
+	}{
+		{"zero block size", Signature{BlockSize: 0}},
+		{"negative size", Signature{BlockSize: 512, Size: -1}},
+		{"missing blocks", Signature{BlockSize: 512, Size: 1024, Blocks: []Block{{Strong: make([]byte, StrongSize)}}}},
+		{"short checksum", Signature{BlockSize: 512, Size: 512, Blocks: []Block{{Strong: make([]byte, 4)}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Diff(tt.sig, bytes.NewReader([]byte("data")), 1024, func(Op) error { return nil })
+			if err == nil {
+				t.Error("Diff accepted an invalid signature")
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ type Entry struct {
 	Speed     float64       `json:"speed"` // bytes/sec
 	Status    string        `json:"status"`
 	Checksum  string        `json:"checksum"`
+	Conflict  string        `json:"conflict,omitempty"` // "renamed" | "overwritten" | "skipped" | "identical"
 }
 
 func historyFile() (string, error) {
@@ -77,27 +78,38 @@ func SaveEntry(e Entry) error {
 	return os.WriteFile(path, data, 0600)
 }
 
-func PrintHistory() error {
+// PrintHistory prints the history as a table, without emoji and arrows
+// when plain is set
+func PrintHistory(plain bool) error {
 	entries, err := LoadEntries()
 	if err != nil {
 		return err
 	}
 
 	if len(entries) == 0 {
-		fmt.Println("\n  No transfer history\n")
+		fmt.Print("\n  No transfer history\n\n")
 		return nil
 	}
 
-	fmt.Println("\n  📋 Transfer History\n")
+	if plain {
+		fmt.Print("\n  Transfer History\n\n")
+	} else {
+		fmt.Print("\n  📋 Transfer History\n\n")
+	}
 	fmt.Println("  Time                | Dir  | File                    | Size    | Speed    | Status")
 	fmt.Println("  " + string([]byte{'-'}) + string([]rune(make([]rune, 100, 100))[0:0]))
 
 	for _, e := range entries {
 		timeStr := e.Time.Format("2006-01-02 15:04:05")
 		dirStr := e.Direction
-		if e.Direction == "send" {
+		switch {
+		case plain && e.Direction == "send":
+			dirStr = "->"
+		case plain:
+			dirStr = "<-"
+		case e.Direction == "send":
 			dirStr = "↑"
-		} else {
+		default:
 			dirStr = "↓"
 		}
 
@@ -109,8 +121,13 @@ func PrintHistory() error {
 			filename = filename[:20] + "..."
 		}
 
+		status := e.Status
+		if e.Conflict != "" && e.Conflict != status {
+			status += " (" + e.Conflict + ")"
+		}
+
 		fmt.Printf("  %-19s | %s  | %-23s | %-7s | %-8s | %s\n",
-			timeStr, dirStr, filename, sizeStr, speedStr, e.Status)
+			timeStr, dirStr, filename, sizeStr, speedStr, status)
 	}
 	fmt.Println()
 	return nil
@@ -2,7 +2,6 @@ package notify
 
 import (
 	"fmt"
-	"os"
 	"os/exec"
 	"runtime"
 )
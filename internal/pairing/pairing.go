@@ -0,0 +1,209 @@
+// Package pairing keeps a long-term secret with a phone, so files can be
+// pushed to it again without scanning a new QR code.
+//
+// Both sides derive a room on the relay from the secret, where the phone
+// page waits while it is open. To send, the computer picks a fresh room and
+// salt and invites the phone there. The transfer itself is an ordinary
+// session whose key is derived from the secret and that salt, so a key
+// that leaks exposes only its own session.
+package pairing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// SecretSize is the length of the secret shared with a device
+const SecretSize = 32
+
+// Labels that separate the keys derived from one secret. The phone page
+// uses the same.
+const (
+	labelRoom    = "pulse room"
+	labelInvite  = "pulse invite"
+	labelSession = "pulse session"
+)
+
+// NewDevice creates a device with a random secret, to be paired through
+// relay
+func NewDevice(name, relay string) (Device, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return Device{}, err
+	}
+	return Device{Name: name, Secret: secret, Relay: relay, PairedAt: time.Now()}, nil
+}
+
+// derive computes HMAC-SHA512 of label and salt under the secret, cut to
+// a key
+func derive(secret []byte, label string, salt []byte) []byte {
+	mac := hmac.New(sha512.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(salt)
+	return mac.Sum(nil)[:crypto.KeySize]
+}
+
+// Room is the token of the room where the device waits for invites
+func (d Device) Room() string {
+	return hex.EncodeToString(derive(d.Secret, labelRoom, nil)[:16])
+}
+
+// PairURL is the link that hands the secret to the phone, in the fragment
+// so it never reaches the relay. computer is what the phone calls us.
+func (d Device) PairURL(computer string) string {
+	httpRelay := strings.Replace(strings.Replace(d.Relay, "wss://", "https://", 1), "ws://", "http://", 1)
+	fragment := url.Values{"k": {crypto.KeyToBase64(d.Secret)}, "n": {computer}}
+	return fmt.Sprintf("%s/p/#%s", httpRelay, fragment.Encode())
+}
+
+// Session is a transfer to a device: a fresh room and a key derived for
+// it alone
+type Session struct {
+	Token string
+	Key   []byte
+	Salt  []byte
+}
+
+// NewSession picks a room and salt for one transfer to d
+func (d Device) NewSession() (Session, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return Session{}, err
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return Session{}, err
+	}
+	return Session{Token: hex.EncodeToString(token), Key: derive(d.Secret, labelSession, salt), Salt: salt}, nil
+}
+
+// message is what the computer and the device say in the device's room,
+// sealed with a key derived from the secret
+type message struct {
+	Type  string `json:"type"` // "hello" and "invite" from the computer, "here" from the device
+	Token string `json:"token,omitempty"`
+	Salt  []byte `json:"salt,omitempty"`
+	// Time dates invites. The page refuses those older than 10 minutes,
+	// so the relay cannot replay them.
+	Time int64 `json:"time,omitempty"`
+}
+
+// WaitForDevice waits until the phone opened the pair link and proved it
+// holds the secret
+func WaitForDevice(ctx context.Context, d Device) error {
+	return d.meet(ctx, message{Type: "hello"}, func(m message) (*message, bool) {
+		return nil, m.Type == "here"
+	})
+}
+
+// Invite asks d to join session s until ctx is cancelled, which should
+// happen once it joined. The invite is sent again whenever the device
+// page (re)opens.
+func Invite(ctx context.Context, d Device, s Session) error {
+	invite := func() message {
+		return message{Type: "invite", Token: s.Token, Salt: s.Salt, Time: time.Now().Unix()}
+	}
+	return d.meet(ctx, invite(), func(m message) (*message, bool) {
+		if m.Type != "here" {
+			return nil, false
+		}
+		reply := invite()
+		return &reply, false
+	})
+}
+
+// meet joins the room of d, says greeting and passes what the device says
+// to answer until answer is done. Lost connections are made again.
+func (d Device) meet(ctx context.Context, greeting message, answer func(message) (*message, bool)) error {
+	wsURL := fmt.Sprintf("%s/ws/%s", d.Relay, d.Room())
+	var lastErr error
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+		if err == nil {
+			err = d.converse(ctx, conn, greeting, answer)
+			if err == nil {
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			if lastErr != nil {
+				return fmt.Errorf("failed to connect to relay: %w", lastErr)
+			}
+			return ctx.Err()
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func (d Device) converse(ctx context.Context, conn *websocket.Conn, greeting message, answer func(message) (*message, bool)) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := d.say(conn, greeting); err != nil {
+		return err
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		m, err := d.hear(data)
+		if err != nil {
+			// Not sealed with our secret, nothing a device would send
+			continue
+		}
+		reply, done := answer(m)
+		if reply != nil {
+			if err := d.say(conn, *reply); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func (d Device) say(conn *websocket.Conn, m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sealed, err := crypto.Encrypt(data, derive(d.Secret, labelInvite, nil))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, sealed)
+}
+
+func (d Device) hear(data []byte) (message, error) {
+	plain, err := crypto.Decrypt(data, derive(d.Secret, labelInvite, nil))
+	if err != nil {
+		return message{}, err
+	}
+	var m message
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return message{}, err
+	}
+	return m, nil
+}
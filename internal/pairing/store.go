@@ -0,0 +1,113 @@
+package pairing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Device is a phone paired with this computer. Secret is shared with the
+// phone and never sent anywhere, it only derives the keys of each session.
+type Device struct {
+	Name     string    `json:"name"`
+	Secret   []byte    `json:"secret"`
+	Relay    string    `json:"relay"`
+	PairedAt time.Time `json:"paired_at"`
+}
+
+func devicesFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".pulse")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "devices.json"), nil
+}
+
+// LoadDevices returns the paired devices in the order they were paired
+func LoadDevices() ([]Device, error) {
+	path, err := devicesFile()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Device{}, nil
+		}
+		return nil, err
+	}
+
+	var devices []Device
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return devices, nil
+}
+
+func saveDevices(devices []Device) error {
+	path, err := devicesFile()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written aside and renamed, so a crash never leaves half the secrets
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// FindDevice returns the paired device called name
+func FindDevice(name string) (Device, error) {
+	devices, err := LoadDevices()
+	if err != nil {
+		return Device{}, err
+	}
+	for _, d := range devices {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Device{}, fmt.Errorf("no device named %q is paired", name)
+}
+
+// SaveDevice stores a newly paired device. Names must be unique.
+func SaveDevice(d Device) error {
+	devices, err := LoadDevices()
+	if err != nil {
+		return err
+	}
+	for _, other := range devices {
+		if other.Name == d.Name {
+			return fmt.Errorf("a device named %q is already paired", d.Name)
+		}
+	}
+	return saveDevices(append(devices, d))
+}
+
+// RemoveDevice forgets the device called name, together with its secret
+func RemoveDevice(name string) error {
+	devices, err := LoadDevices()
+	if err != nil {
+		return err
+	}
+	for i, d := range devices {
+		if d.Name == name {
+			return saveDevices(append(devices[:i], devices[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no device named %q is paired", name)
+}
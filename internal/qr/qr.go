@@ -2,17 +2,25 @@ package qr
 
 import (
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/skip2/go-qrcode"
 )
 
 func GenerateTerminal(content string) error {
+	return GenerateTerminalTo(os.Stdout, content)
+}
+
+// GenerateTerminalTo prints the QR code to w, e.g. stderr when stdout is
+// carrying data
+func GenerateTerminalTo(w io.Writer, content string) error {
 	qr, err := qrcode.New(content, qrcode.Medium)
 	if err != nil {
 		return err
 	}
-	fmt.Println()
-	fmt.Println(qr.ToSmallString(false))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, qr.ToSmallString(false))
 	return nil
 }
 
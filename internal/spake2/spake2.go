@@ -0,0 +1,209 @@
+// Package spake2 implements the SPAKE2 password-authenticated key exchange
+// of RFC 9382 on P-256. Two sides that share a short password agree on a
+// strong key, and whoever sees the messages, such as the relay, learns
+// nothing that lets it test guesses of the password offline. An active
+// attacker gets one guess per exchange.
+package spake2
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Role tells the two sides apart. Each blinds its message with a point of
+// its own.
+type Role int
+
+const (
+	RoleA Role = iota
+	RoleB
+)
+
+// KeySize is the length of the shared key
+const KeySize = 32
+
+var curve = elliptic.P256()
+
+// The blinding points M and N are hashed onto the curve from fixed
+// strings, so nobody knows their discrete logarithms
+var (
+	blindOnce      sync.Once
+	mX, mY, nX, nY *big.Int
+)
+
+func blinding() {
+	mX, mY = hashToCurve("pulse spake2 M")
+	nX, nY = hashToCurve("pulse spake2 N")
+}
+
+// hashToCurve finds a point by try-and-increment: the first counter whose
+// hash is the x coordinate of a point, taking the even y
+func hashToCurve(seed string) (*big.Int, *big.Int) {
+	p := curve.Params().P
+	three := big.NewInt(3)
+	for counter := uint32(0); ; counter++ {
+		h := sha256.New()
+		h.Write([]byte(seed))
+		binary.Write(h, binary.BigEndian, counter)
+		x := new(big.Int).SetBytes(h.Sum(nil))
+		x.Mod(x, p)
+
+		// y² = x³ - 3x + b
+		rhs := new(big.Int).Exp(x, three, p)
+		rhs.Sub(rhs, new(big.Int).Mul(three, x))
+		rhs.Add(rhs, curve.Params().B)
+		rhs.Mod(rhs, p)
+		y := new(big.Int).ModSqrt(rhs, p)
+		if y == nil {
+			continue
+		}
+		if y.Bit(0) == 1 {
+			y.Sub(p, y)
+		}
+		if curve.IsOnCurve(x, y) {
+			return x, y
+		}
+	}
+}
+
+// Exchange is one side of a key exchange
+type Exchange struct {
+	role    Role
+	w       *big.Int
+	x       *big.Int
+	message []byte
+
+	transcript []byte
+	key        []byte
+	confirmA   []byte
+	confirmB   []byte
+}
+
+// New starts an exchange for role with the shared password
+func New(role Role, password []byte) (*Exchange, error) {
+	blindOnce.Do(blinding)
+	n := curve.Params().N
+
+	// w is the password as a scalar. It is reduced from 64 bytes, so the
+	// bias is negligible.
+	wBytes := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, password, nil, []byte("pulse spake2 w")), wBytes); err != nil {
+		return nil, err
+	}
+	w := new(big.Int).SetBytes(wBytes)
+	w.Mod(w, n)
+
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	x.Add(x, big.NewInt(1))
+
+	// Our message is x·G + w·M for A, x·G + w·N for B
+	bx, by := mX, mY
+	if role == RoleB {
+		bx, by = nX, nY
+	}
+	gx, gy := curve.ScalarBaseMult(scalar(x))
+	wx, wy := curve.ScalarMult(bx, by, scalar(w))
+	tx, ty := curve.Add(gx, gy, wx, wy)
+
+	return &Exchange{role: role, w: w, x: x, message: elliptic.MarshalCompressed(curve, tx, ty)}, nil
+}
+
+// Message is what to send to the other side
+func (e *Exchange) Message() []byte {
+	return e.message
+}
+
+// Finish takes the message of the other side and returns the shared key.
+// A wrong password still yields a key, a different one, so confirm it
+// before use.
+func (e *Exchange) Finish(peer []byte) ([]byte, error) {
+	if e.key != nil {
+		return nil, errors.New("exchange already finished")
+	}
+	px, py := elliptic.UnmarshalCompressed(curve, peer)
+	if px == nil {
+		return nil, errors.New("invalid key exchange message")
+	}
+
+	// Remove the peer's blinding: K = x·(P - w·N) for A, x·(P - w·M) for B
+	bx, by := nX, nY
+	if e.role == RoleB {
+		bx, by = mX, mY
+	}
+	wx, wy := curve.ScalarMult(bx, by, scalar(e.w))
+	wy.Sub(curve.Params().P, wy)
+	qx, qy := curve.Add(px, py, wx, wy)
+	kx, ky := curve.ScalarMult(qx, qy, scalar(e.x))
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, errors.New("invalid key exchange message")
+	}
+
+	pA, pB := e.message, peer
+	if e.role == RoleB {
+		pA, pB = peer, e.message
+	}
+	// TT from RFC 9382, without identities
+	var tt []byte
+	for _, part := range [][]byte{nil, nil, pA, pB, elliptic.Marshal(curve, kx, ky), scalar(e.w)} {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(part)))
+		tt = append(tt, part...)
+	}
+	e.transcript = tt
+
+	hash := sha256.Sum256(tt)
+	keys := make([]byte, KeySize+64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, hash[:], nil, []byte("pulse spake2 keys")), keys); err != nil {
+		return nil, fmt.Errorf("failed to derive keys: %w", err)
+	}
+	e.key = keys[:KeySize]
+	e.confirmA = keys[KeySize : KeySize+32]
+	e.confirmB = keys[KeySize+32:]
+	return e.key, nil
+}
+
+// Confirmation proves to the other side that we derived the same key.
+// Only valid after Finish.
+func (e *Exchange) Confirmation() []byte {
+	key := e.confirmA
+	if e.role == RoleB {
+		key = e.confirmB
+	}
+	return e.mac(key)
+}
+
+// Verify checks the confirmation of the other side
+func (e *Exchange) Verify(confirmation []byte) bool {
+	if e.transcript == nil {
+		return false
+	}
+	key := e.confirmB
+	if e.role == RoleB {
+		key = e.confirmA
+	}
+	return hmac.Equal(confirmation, e.mac(key))
+}
+
+func (e *Exchange) mac(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(e.transcript)
+	return mac.Sum(nil)
+}
+
+// scalar encodes k in the 32 bytes the curve expects
+func scalar(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, 32))
+}
@@ -0,0 +1,117 @@
+package spake2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		agree bool
+	}{
+		{"matching code", "7-purple-sausage", "7-purple-sausage", true},
+		{"wrong word", "7-purple-sausage", "7-purple-sandwich", false},
+		{"wrong nameplate", "7-purple-sausage", "8-purple-sausage", false},
+		{"empty password", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := New(RoleA, []byte(tt.a))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := New(RoleB, []byte(tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyA, err := a.Finish(b.Message())
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyB, err := b.Finish(a.Message())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := bytes.Equal(keyA, keyB); got != tt.agree {
+				t.Errorf("keys equal = %v, want %v", got, tt.agree)
+			}
+			if got := a.Verify(b.Confirmation()); got != tt.agree {
+				t.Errorf("A verifies B = %v, want %v", got, tt.agree)
+			}
+			if got := b.Verify(a.Confirmation()); got != tt.agree {
+				t.Errorf("B verifies A = %v, want %v", got, tt.agree)
+			}
+		})
+	}
+}
+
+func TestConfirmationIsNotReflected(t *testing.T) {
+	// A relay that echoes A's own confirmation back must not pass
+	a, err := New(RoleA, []byte("7-purple-sausage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(RoleB, []byte("7-purple-sausage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Finish(b.Message()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Verify(a.Confirmation()) {
+		t.Error("A accepted its own confirmation")
+	}
+}
+
+func TestFinishRejects(t *testing.T) {
+	a, err := New(RoleA, []byte("7-purple-sausage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		peer []byte
+	}{
+		{"empty", nil},
+		{"truncated", a.Message()[:16]},
+		{"not on the curve", bytes.Repeat([]byte{0xff}, 33)},
+		{"uncompressed", append([]byte{4}, make([]byte, 64)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := a.Finish(tt.peer); err == nil {
+				t.Error("Finish accepted an invalid message")
+			}
+		})
+	}
+}
+
+func TestVerifyBeforeFinish(t *testing.T) {
+	a, err := New(RoleA, []byte("7-purple-sausage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Verify(nil) {
+		t.Error("Verify passed before Finish")
+	}
+}
+
+func TestFinishTwice(t *testing.T) {
+	a, err := New(RoleA, []byte("7-purple-sausage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(RoleB, []byte("7-purple-sausage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Finish(b.Message()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Finish(b.Message()); err == nil {
+		t.Error("Finish ran twice")
+	}
+}
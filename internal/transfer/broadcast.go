@@ -0,0 +1,126 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MaxRecipients is the most receivers the relay serves in one broadcast
+const MaxRecipients = 32
+
+// Broadcast sends the same entries to several receivers that open the same
+// link. Each receiver is served by its own lane, an ordinary Sender with a
+// connection of its own that the relay pairs with that receiver, so flow
+// control, retries and resumption of one receiver never hold up the others.
+type Broadcast struct {
+	lanes  []*Sender
+	config Config
+	// mu keeps the lanes from calling the observer concurrently
+	mu sync.Mutex
+}
+
+// RecipientResult is how a batch went for one receiver of a broadcast
+type RecipientResult struct {
+	Stats []Stats
+	Err   error
+}
+
+func NewBroadcast(relayURL, token string, key []byte, recipients int, cfg Config) *Broadcast {
+	b := &Broadcast{config: cfg.withDefaults()}
+	for i := 0; i < recipients; i++ {
+		laneCfg := b.config
+		recipient := i
+		if b.config.Observer != nil {
+			laneCfg.Observer = ObserverFunc(func(e Event) {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				b.config.Observer.Observe(RecipientEvent{Recipient: recipient, Event: e})
+			})
+		}
+		if b.config.Logf != nil {
+			laneCfg.Logf = func(format string, args ...interface{}) {
+				b.config.Logf("[recipient %d] "+format, append([]interface{}{recipient + 1}, args...)...)
+			}
+		}
+		lane := NewSender(relayURL, token, key, laneCfg)
+		lane.recipients = recipients
+		b.lanes = append(b.lanes, lane)
+	}
+	return b
+}
+
+// Connect joins the relay with every lane. It should happen before the
+// link is handed out, so receivers find the room set up for a broadcast.
+// Cancelling ctx stops it, and the lanes that joined are closed.
+func (b *Broadcast) Connect(ctx context.Context) error {
+	if len(b.lanes) < 1 || len(b.lanes) > MaxRecipients {
+		return fmt.Errorf("a broadcast needs between 1 and %d recipients", MaxRecipients)
+	}
+	for _, lane := range b.lanes {
+		if err := lane.Connect(ctx); err != nil {
+			b.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// SendBatch sends entries to every receiver as soon as it joins, all at
+// once. Receivers fail independently: the results hold the stats or error
+// of each, and the error tells how many did not get the batch.
+func (b *Broadcast) SendBatch(ctx context.Context, entries []Entry) ([]RecipientResult, error) {
+	// Hash once rather than on every lane
+	entries = append([]Entry(nil), entries...)
+	b.config.emit(PhaseEvent{Phase: PhaseHashing})
+	for i := range entries {
+		entry := &entries[i]
+		if entry.IsDir || entry.LinkTarget != "" || entry.Checksum != "" {
+			continue
+		}
+		checksum, err := checksumFile(entry.LocalPath)
+		if err != nil {
+			return nil, err
+		}
+		entry.Checksum = checksum
+	}
+
+	results := make([]RecipientResult, len(b.lanes))
+	var wg sync.WaitGroup
+	for i, lane := range b.lanes {
+		wg.Add(1)
+		go func(result *RecipientResult, lane *Sender) {
+			defer wg.Done()
+			// A lane left open after its receiver is gone would be paired
+			// with the next receiver instead of a lane still waiting
+			defer lane.Close()
+			if err := lane.WaitForReceiver(ctx, b.config.Timeout); err != nil {
+				result.Err = err
+				return
+			}
+			result.Stats, result.Err = lane.SendBatch(ctx, entries, nil)
+		}(&results[i], lane)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d recipients did not receive the files", failed, len(results))
+	}
+	return results, nil
+}
+
+func (b *Broadcast) Close() error {
+	var err error
+	for _, lane := range b.lanes {
+		if cerr := lane.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
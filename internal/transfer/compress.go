@@ -0,0 +1,77 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// compressor deflates chunks one at a time, so every chunk can be inflated
+// on its own and chunks that do not shrink can be sent as they are
+type compressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	// BestSpeed keeps up with the relay; the gains of higher levels on
+	// 64KB chunks are small
+	c.w, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	return c
+}
+
+// chunkMessage returns the message for one chunk, compressed if that makes
+// it smaller
+func (c *compressor) chunkMessage(data []byte) Message {
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(data); err != nil || c.w.Close() != nil || c.buf.Len() >= len(data) {
+		return NewChunkMessage(data)
+	}
+	return Message{Type: MsgTypeCompressedChunk, Payload: c.buf.Bytes()}
+}
+
+// decompressChunk inflates a compressed chunk, refusing output beyond the
+// chunk size limit
+func decompressChunk(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, MaxChunkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress chunk: %w", err)
+	}
+	if len(data) > MaxChunkSize {
+		return nil, fmt.Errorf("decompressed chunk exceeds the %d byte limit", MaxChunkSize)
+	}
+	return data, nil
+}
+
+// compressedTypes are formats that are already compressed, where deflating
+// again only costs time
+var compressedTypes = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-xz", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/pdf", "application/epub+zip", "application/java-archive",
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+	"font/woff",
+}
+
+// compressible reports whether a file of the given MIME type is worth
+// compressing
+func compressible(mimeType string) bool {
+	if mimeType == "image/svg+xml" || mimeType == "image/bmp" {
+		return true
+	}
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(mimeType, t) {
+			return false
+		}
+	}
+	return true
+}
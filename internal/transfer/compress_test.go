@@ -0,0 +1,122 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunkMessage(t *testing.T) {
+	random := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name           string
+		data           []byte
+		wantCompressed bool
+	}{
+		{"text", []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)), true},
+		{"zeros", make([]byte, 64<<10), true},
+		{"random", random, false},
+		{"tiny", []byte("a"), false},
+		{"empty", nil, false},
+	}
+	c := newCompressor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := c.chunkMessage(tt.data)
+			if compressed := msg.Type == MsgTypeCompressedChunk; compressed != tt.wantCompressed {
+				t.Fatalf("compressed = %v, want %v", compressed, tt.wantCompressed)
+			}
+			got := msg.Payload
+			if tt.wantCompressed {
+				if len(msg.Payload) >= len(tt.data) {
+					t.Errorf("compressed %d bytes to %d", len(tt.data), len(msg.Payload))
+				}
+				var err error
+				if got, err = decompressChunk(msg.Payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Error("chunk does not round-trip")
+			}
+		})
+	}
+}
+
+func TestDecompressChunkRejects(t *testing.T) {
+	deflate := func(data []byte) []byte {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"beyond the chunk limit", deflate(make([]byte, MaxChunkSize+1))},
+		{"garbage", []byte{0xff, 0xfe, 0xfd, 0xfc}},
+		{"truncated", deflate([]byte(strings.Repeat("abc", 1000)))[:10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decompressChunk(tt.payload); err == nil {
+				t.Error("decompressChunk() succeeded")
+			}
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     bool
+	}{
+		{"text/plain; charset=utf-8", true},
+		{"application/json", true},
+		{"application/octet-stream", true},
+		{"image/svg+xml", true},
+		{"image/bmp", true},
+		{"image/jpeg", false},
+		{"video/mp4", false},
+		{"application/zip", false},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", false},
+	}
+	for _, tt := range tests {
+		if got := compressible(tt.mimeType); got != tt.want {
+			t.Errorf("compressible(%q) = %v, want %v", tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		shrunk bool // less than half of the data crosses the relay
+	}{
+		{"text", []byte(strings.Repeat("line of a log file that repeats\n", 20000)), true},
+		{"random", randomBytes(200<<10, 2), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dest := t.TempDir(), t.TempDir()
+			writeFile(t, filepath.Join(src, "file.txt"), tt.data)
+			relay, relayURL := newTestRelay(t, 0)
+			sender, receiver := connectPeers(t, relayURL, Config{Compress: true}, Config{})
+			sent, path, _ := sendFile(t, sender, receiver, filepath.Join(src, "file.txt"), dest)
+			checkContent(t, path, tt.data)
+			if !sent.Verified {
+				t.Error("checksum was not confirmed")
+			}
+			if shrunk := relay.forwardedBytes() < len(tt.data)/2; shrunk != tt.shrunk {
+				t.Errorf("relay forwarded %d bytes for %d bytes of data", relay.forwardedBytes(), len(tt.data))
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when a received entry already exists
+// in the destination
+type ConflictPolicy string
+
+const (
+	ConflictRename    ConflictPolicy = "rename"    // keep both, adding a numeric suffix to the new one
+	ConflictOverwrite ConflictPolicy = "overwrite" // replace files, merge into directories
+	ConflictSkip      ConflictPolicy = "skip"      // keep what exists and discard the incoming entry
+	ConflictAsk       ConflictPolicy = "ask"       // let Config.Ask decide for every conflict
+)
+
+// Actions recorded in ReceivedFile.Conflict
+const (
+	ActionRenamed     = "renamed"
+	ActionOverwritten = "overwritten"
+	ActionSkipped     = "skipped"
+	ActionIdentical   = "identical" // the same file was already there, nothing was sent
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictRename, ConflictOverwrite, ConflictSkip, ConflictAsk:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, use rename, overwrite, skip or ask", s)
+}
+
+// conflicts applies a conflict policy across the entries of a batch. When a
+// directory is renamed or skipped, everything below it follows.
+type conflicts struct {
+	destDir string
+	policy  ConflictPolicy
+	ask     func(path string) ConflictPolicy
+	moved   map[string]string // announced directory -> directory used, "" if skipped
+
+	// Filled in from the batch manifest: files already present and the
+	// directories holding them
+	identical map[string]bool
+	merge     map[string]bool
+}
+
+func newConflicts(destDir string, cfg Config) *conflicts {
+	policy := cfg.OnConflict
+	if policy == "" {
+		policy = ConflictRename
+	}
+	return &conflicts{
+		destDir:   destDir,
+		policy:    policy,
+		ask:       cfg.Ask,
+		moved:     map[string]string{},
+		identical: map[string]bool{},
+		merge:     map[string]bool{},
+	}
+}
+
+// resolve returns the relative path to write meta to and the action taken,
+// if any
+func (c *conflicts) resolve(meta Metadata) (string, string, error) {
+	rel := meta.RelPath()
+
+	// Follow a parent directory that was renamed or skipped
+	parts := strings.Split(rel, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		to, ok := c.moved[strings.Join(parts[:i], "/")]
+		if !ok {
+			continue
+		}
+		if to == "" {
+			return rel, ActionSkipped, nil
+		}
+		rel = path.Join(append([]string{to}, parts[i:]...)...)
+		break
+	}
+
+	destPath, err := safeJoin(c.destDir, rel)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Lstat(destPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return rel, "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to inspect %s: %w", destPath, err)
+	}
+
+	if meta.IsDir && info.IsDir() && c.merging(rel) {
+		// The same directory sent again, complete it rather than making a
+		// copy
+		return rel, "", nil
+	}
+
+	policy := c.policy
+	if policy == ConflictAsk {
+		policy = ConflictRename
+		if c.ask != nil {
+			policy = c.ask(destPath)
+		}
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		if meta.IsDir != info.IsDir() {
+			return "", "", fmt.Errorf("cannot overwrite %s, one is a directory and the other is not", destPath)
+		}
+		if meta.IsDir {
+			// Merge into the existing directory
+			return rel, "", nil
+		}
+		return rel, ActionOverwritten, nil
+	case ConflictSkip:
+		if meta.IsDir {
+			c.moved[meta.RelPath()] = ""
+		}
+		return rel, ActionSkipped, nil
+	default:
+		renamed, err := c.freeName(rel, meta.IsDir)
+		if err != nil {
+			return "", "", err
+		}
+		if meta.IsDir {
+			c.moved[meta.RelPath()] = renamed
+		}
+		return renamed, ActionRenamed, nil
+	}
+}
+
+// merging reports whether rel is, or lies below, a directory holding files
+// the receiver already has
+func (c *conflicts) merging(rel string) bool {
+	for dir := rel; dir != "."; dir = path.Dir(dir) {
+		if c.merge[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// freeName finds the first "name (n).ext" that does not exist yet
+func (c *conflicts) freeName(rel string, isDir bool) (string, error) {
+	dir, base := path.Split(rel)
+	ext := path.Ext(base)
+	if isDir || ext == base {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for n := 1; n < 10000; n++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, n, ext)
+		destPath, err := safeJoin(c.destDir, candidate)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Lstat(destPath); errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name left for %s", rel)
+}
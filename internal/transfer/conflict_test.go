@@ -0,0 +1,188 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	type result struct {
+		rel    string
+		action string
+	}
+	file := func(p string) Metadata { return Metadata{Filename: filepath.Base(p), Path: p} }
+	dir := func(p string) Metadata { return Metadata{Filename: filepath.Base(p), Path: p, IsDir: true} }
+	tests := []struct {
+		name     string
+		existing []string // directories end in a slash
+		policy   ConflictPolicy
+		ask      ConflictPolicy // answer of Config.Ask, none if empty
+		merge    []string       // directories the manifest found files in
+		entries  []Metadata
+		want     []result
+		wantErr  bool // for the last entry
+	}{
+		{
+			name:    "no conflict",
+			entries: []Metadata{file("a.txt"), dir("d"), file("d/b.txt")},
+			want:    []result{{"a.txt", ""}, {"d", ""}, {"d/b.txt", ""}},
+		},
+		{
+			name:     "rename file",
+			existing: []string{"a.txt"},
+			entries:  []Metadata{file("a.txt")},
+			want:     []result{{"a (1).txt", ActionRenamed}},
+		},
+		{
+			name:     "rename past taken names",
+			existing: []string{"a.txt", "a (1).txt", "a (2).txt"},
+			entries:  []Metadata{file("a.txt")},
+			want:     []result{{"a (3).txt", ActionRenamed}},
+		},
+		{
+			name:     "rename without extension",
+			existing: []string{"README", ".bashrc"},
+			entries:  []Metadata{file("README"), file(".bashrc")},
+			want:     []result{{"README (1)", ActionRenamed}, {".bashrc (1)", ActionRenamed}},
+		},
+		{
+			name:     "renamed directory takes its entries along",
+			existing: []string{"v1.2/", "v1.2/a.txt"},
+			entries:  []Metadata{dir("v1.2"), file("v1.2/a.txt"), dir("v1.2/sub"), file("v1.2/sub/b.txt")},
+			want:     []result{{"v1.2 (1)", ActionRenamed}, {"v1.2 (1)/a.txt", ""}, {"v1.2 (1)/sub", ""}, {"v1.2 (1)/sub/b.txt", ""}},
+		},
+		{
+			name:     "overwrite file",
+			existing: []string{"a.txt"},
+			policy:   ConflictOverwrite,
+			entries:  []Metadata{file("a.txt")},
+			want:     []result{{"a.txt", ActionOverwritten}},
+		},
+		{
+			name:     "overwrite merges directories",
+			existing: []string{"d/", "d/a.txt"},
+			policy:   ConflictOverwrite,
+			entries:  []Metadata{dir("d"), file("d/a.txt"), file("d/b.txt")},
+			want:     []result{{"d", ""}, {"d/a.txt", ActionOverwritten}, {"d/b.txt", ""}},
+		},
+		{
+			name:     "overwrite directory with file",
+			existing: []string{"d/"},
+			policy:   ConflictOverwrite,
+			entries:  []Metadata{file("d")},
+			wantErr:  true,
+		},
+		{
+			name:     "overwrite file with directory",
+			existing: []string{"d"},
+			policy:   ConflictOverwrite,
+			entries:  []Metadata{dir("d")},
+			wantErr:  true,
+		},
+		{
+			name:     "skip file",
+			existing: []string{"a.txt"},
+			policy:   ConflictSkip,
+			entries:  []Metadata{file("a.txt"), file("b.txt")},
+			want:     []result{{"a.txt", ActionSkipped}, {"b.txt", ""}},
+		},
+		{
+			name:     "skipped directory takes its entries along",
+			existing: []string{"d/"},
+			policy:   ConflictSkip,
+			entries:  []Metadata{dir("d"), file("d/new.txt"), dir("d/sub"), file("d/sub/x")},
+			want:     []result{{"d", ActionSkipped}, {"d/new.txt", ActionSkipped}, {"d/sub", ActionSkipped}, {"d/sub/x", ActionSkipped}},
+		},
+		{
+			name:     "ask",
+			existing: []string{"a.txt"},
+			policy:   ConflictAsk,
+			ask:      ConflictOverwrite,
+			entries:  []Metadata{file("a.txt")},
+			want:     []result{{"a.txt", ActionOverwritten}},
+		},
+		{
+			name:     "ask without anyone to ask",
+			existing: []string{"a.txt"},
+			policy:   ConflictAsk,
+			entries:  []Metadata{file("a.txt")},
+			want:     []result{{"a (1).txt", ActionRenamed}},
+		},
+		{
+			name:     "directory sent again is completed",
+			existing: []string{"d/", "d/a.txt"},
+			merge:    []string{"d"},
+			entries:  []Metadata{dir("d"), dir("d/sub"), file("d/b.txt")},
+			want:     []result{{"d", ""}, {"d/sub", ""}, {"d/b.txt", ""}},
+		},
+		{
+			name:    "escaping the destination",
+			entries: []Metadata{file("../a.txt")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destDir := t.TempDir()
+			for _, p := range tt.existing {
+				full := filepath.Join(destDir, filepath.FromSlash(p))
+				var err error
+				if strings.HasSuffix(p, "/") {
+					err = os.MkdirAll(full, 0755)
+				} else {
+					err = os.WriteFile(full, nil, 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := Config{OnConflict: tt.policy}
+			if tt.ask != "" {
+				cfg.Ask = func(string) ConflictPolicy { return tt.ask }
+			}
+			c := newConflicts(destDir, cfg)
+			for _, dir := range tt.merge {
+				c.merge[dir] = true
+			}
+			for i, meta := range tt.entries {
+				rel, action, err := c.resolve(meta)
+				if i == len(tt.entries)-1 && tt.wantErr {
+					if err == nil {
+						t.Fatalf("resolve(%s) = %q, want an error", meta.RelPath(), rel)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("resolve(%s): %v", meta.RelPath(), err)
+				}
+				if got := (result{rel, action}); got != tt.want[i] {
+					t.Errorf("resolve(%s) = %v, want %v", meta.RelPath(), got, tt.want[i])
+				}
+				// Create what was received, as the receiver would
+				if action == "" || action == ActionRenamed {
+					full := filepath.Join(destDir, filepath.FromSlash(rel))
+					if meta.IsDir {
+						os.MkdirAll(full, 0755)
+					} else {
+						os.WriteFile(full, nil, 0644)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, s := range []string{"rename", "overwrite", "skip", "ask"} {
+		if p, err := ParseConflictPolicy(s); err != nil || string(p) != s {
+			t.Errorf("ParseConflictPolicy(%q) = %q, %v", s, p, err)
+		}
+	}
+	for _, s := range []string{"", "Rename", "replace"} {
+		if _, err := ParseConflictPolicy(s); err == nil {
+			t.Errorf("ParseConflictPolicy(%q) succeeded", s)
+		}
+	}
+}
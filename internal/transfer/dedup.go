@@ -0,0 +1,146 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+)
+
+// exchangeManifest announces the files of a batch to receivers that support
+// it and returns the batch indexes they already have. Checksums are stored
+// in entries so the files are not hashed again when they are sent.
+func (s *Sender) exchangeManifest(ctx context.Context, entries []Entry) (map[int]bool, error) {
+	if !s.session.Has(CapDedup) {
+		return nil, nil
+	}
+	s.config.emit(PhaseEvent{Phase: PhaseHashing})
+	var manifest Manifest
+	files := 0
+	for i := range entries {
+		entry := &entries[i]
+		if !s.canSend(*entry) {
+			continue
+		}
+		if entry.IsDir || entry.LinkTarget != "" {
+			manifest.Entries = append(manifest.Entries, ManifestEntry{})
+			continue
+		}
+		if entry.Checksum == "" {
+			checksum, err := checksumFile(entry.LocalPath)
+			if err != nil {
+				return nil, err
+			}
+			entry.Checksum = checksum
+		}
+		manifest.Entries = append(manifest.Entries, ManifestEntry{Path: entry.RelPath, Size: entry.Size, Checksum: entry.Checksum})
+		files++
+	}
+	if files == 0 {
+		return nil, nil
+	}
+	msg, err := NewManifestMessage(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := s.send(msg); err != nil {
+			return nil, fmt.Errorf("failed to send manifest: %w", err)
+		}
+		have, err := s.awaitHave(ctx)
+		if errors.Is(err, errPeerRejoined) && attempt < s.config.Retries {
+			s.debug("Receiver reconnected before answering the manifest, sending it again")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		identical := make(map[int]bool, len(have.Indexes))
+		for _, index := range have.Indexes {
+			identical[index] = true
+		}
+		s.debug("Receiver already has %d of %d files", len(identical), files)
+		return identical, nil
+	}
+}
+
+func (s *Sender) awaitHave(ctx context.Context) (*Have, error) {
+	s.have = nil
+	timer := time.NewTimer(s.config.Timeout)
+	defer timer.Stop()
+	for s.have == nil {
+		select {
+		case in, ok := <-s.inbox:
+			if err := s.handle(in, ok); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, errors.New("timeout waiting for receiver to answer the manifest")
+		}
+	}
+	return s.have, nil
+}
+
+func checksumFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	checksum, err := crypto.ComputeChecksumReader(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file for checksum: %w", err)
+	}
+	return checksum, nil
+}
+
+// checkManifest returns the batch indexes of the files the destination
+// already holds with the same checksum at the announced path. Directories
+// holding such a file are merged into rather than renamed, so a batch sent
+// again completes the earlier copy.
+func (c *conflicts) checkManifest(manifest Manifest) []int {
+	indexes := []int{}
+	if c == nil {
+		return indexes
+	}
+	for i, entry := range manifest.Entries {
+		if entry.Path == "" || entry.Checksum == "" {
+			continue
+		}
+		rel, err := SanitizePath(entry.Path)
+		if err != nil {
+			continue
+		}
+		destPath, err := safeJoin(c.destDir, rel)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(destPath)
+		if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size {
+			continue
+		}
+		checksum, err := checksumFile(destPath)
+		if err != nil || checksum != entry.Checksum {
+			continue
+		}
+		indexes = append(indexes, i)
+		c.identical[rel] = true
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			c.merge[dir] = true
+		}
+	}
+	return indexes
+}
+
+// isIdentical reports whether the receiver named the file in its answer to
+// the manifest
+func (c *conflicts) isIdentical(rel string) bool {
+	return c != nil && c.identical[rel]
+}
@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+)
+
+func TestCheckManifest(t *testing.T) {
+	same := []byte("same content")
+	entry := func(p string, data []byte) ManifestEntry {
+		return ManifestEntry{Path: p, Size: int64(len(data)), Checksum: crypto.ComputeChecksum(data)}
+	}
+	tests := []struct {
+		name      string
+		existing  map[string]string
+		manifest  []ManifestEntry
+		want      []int
+		wantMerge []string
+	}{
+		{
+			name:     "nothing there",
+			manifest: []ManifestEntry{entry("a.txt", same)},
+			want:     []int{},
+		},
+		{
+			name:      "same file",
+			existing:  map[string]string{"a.txt": string(same), "d/sub/b.txt": string(same)},
+			manifest:  []ManifestEntry{entry("a.txt", same), entry("d/sub/b.txt", same)},
+			want:      []int{0, 1},
+			wantMerge: []string{"d", "d/sub"},
+		},
+		{
+			name:     "different content",
+			existing: map[string]string{"a.txt": "other content"},
+			manifest: []ManifestEntry{entry("a.txt", same)},
+			want:     []int{},
+		},
+		{
+			name:     "different size",
+			existing: map[string]string{"a.txt": "same content and more"},
+			manifest: []ManifestEntry{entry("a.txt", same)},
+			want:     []int{},
+		},
+		{
+			name:     "same content elsewhere",
+			existing: map[string]string{"b.txt": string(same)},
+			manifest: []ManifestEntry{entry("a.txt", same)},
+			want:     []int{},
+		},
+		{
+			name:     "directories and links are not compared",
+			existing: map[string]string{"a.txt": string(same)},
+			manifest: []ManifestEntry{{}, entry("a.txt", same)},
+			want:     []int{1},
+		},
+		{
+			name:     "compared where sanitized paths land",
+			existing: map[string]string{"a.txt": string(same)},
+			manifest: []ManifestEntry{entry("../a.txt", same), entry("/etc/passwd", same)},
+			want:     []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destDir := t.TempDir()
+			for p, content := range tt.existing {
+				full := filepath.Join(destDir, filepath.FromSlash(p))
+				if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, full, []byte(content))
+			}
+			c := newConflicts(destDir, Config{})
+			got := c.checkManifest(Manifest{Entries: tt.manifest})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkManifest() = %v, want %v", got, tt.want)
+			}
+			for _, i := range tt.want {
+				if rel, _ := SanitizePath(tt.manifest[i].Path); !c.isIdentical(rel) {
+					t.Errorf("%s is not marked identical", rel)
+				}
+			}
+			var merge []string
+			for dir := range c.merge {
+				merge = append(merge, dir)
+			}
+			sort.Strings(merge)
+			if !reflect.DeepEqual(merge, tt.wantMerge) {
+				t.Errorf("merged directories = %v, want %v", merge, tt.wantMerge)
+			}
+		})
+	}
+}
+
+func TestBatchSentAgainSkipsIdentical(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	randomFile(t, filepath.Join(src, "dir"), "kept.bin", 8192, 4)
+	randomFile(t, filepath.Join(src, "dir"), "changed.bin", 8192, 5)
+	entries, err := CollectEntries([]string{filepath.Join(src, "dir")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func() []ReceivedFile {
+		t.Helper()
+		_, relayURL := newTestRelay(t, 0)
+		sender, receiver := connectPeers(t, relayURL, Config{}, Config{})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var sendErr error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, sendErr = sender.SendBatch(ctx, append([]Entry(nil), entries...), nil)
+		}()
+		received, err := receiver.ReceiveBatch(ctx, dest, nil)
+		<-done
+		if sendErr != nil || err != nil {
+			t.Fatalf("send: %v, receive: %v", sendErr, err)
+		}
+		return received
+	}
+
+	send()
+	changed := randomFile(t, filepath.Join(dest, "dir"), "changed.bin", 8192, 6)
+	received := send()
+
+	actions := map[string]string{}
+	for _, file := range received {
+		actions[file.Metadata.RelPath()] = file.Conflict
+	}
+	want := map[string]string{"dir": "", "dir/kept.bin": ActionIdentical, "dir/changed.bin": ActionRenamed}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("second batch: %v, want %v", actions, want)
+	}
+	checkContent(t, filepath.Join(dest, "dir", "changed.bin"), changed)
+	if _, err := os.Stat(filepath.Join(dest, "dir (1)")); err == nil {
+		t.Error("the directory was copied instead of completed")
+	}
+}
@@ -0,0 +1,123 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fromjyce/pulse/internal/delta"
+)
+
+// awaitSignature waits for the receiver to describe its copy of the file
+// announced for a delta transfer
+func (s *Sender) awaitSignature(ctx context.Context) (*delta.Signature, error) {
+	s.sig = nil
+	timer := time.NewTimer(s.config.Timeout)
+	defer timer.Stop()
+	for s.sig == nil {
+		select {
+		case in, ok := <-s.inbox:
+			if err := s.handle(in, ok); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, errors.New("timeout waiting for receiver to send a signature")
+		}
+	}
+	if len(s.sig.Blocks) > 0 {
+		if err := s.sig.Validate(); err != nil {
+			return nil, fmt.Errorf("receiver sent a bad signature: %w", err)
+		}
+	}
+	return s.sig, nil
+}
+
+// sendDelta sends file as literal chunks and copies of the receiver's
+// blocks. It returns the number of literal bytes sent and the size of the
+// rebuilt file.
+func (s *Sender) sendDelta(ctx context.Context, file io.Reader, sig delta.Signature, comp *compressor, meta Metadata, progressFn func(sent, total int64)) (int64, int64, error) {
+	s.debug("Receiver has %d bytes of an earlier %s, sending the differences", sig.Size, meta.Filename)
+	var bytesSent, position int64
+	err := delta.Diff(sig, file, s.chunkSize(), func(op delta.Op) error {
+		if err := s.checkCredit(ctx, position); err != nil {
+			return err
+		}
+		n := int64(len(op.Data))
+		if op.Data != nil {
+			if err := s.send(chunkMessage(comp, op.Data)); err != nil {
+				return fmt.Errorf("failed to send chunk: %w", err)
+			}
+			bytesSent += n
+		} else {
+			_, length, err := sig.Range(op.Block, op.Blocks)
+			if err != nil {
+				return err
+			}
+			copyMsg, err := NewCopyMessage(Copy{Block: op.Block, Blocks: op.Blocks})
+			if err != nil {
+				return err
+			}
+			if err := s.send(copyMsg); err != nil {
+				return fmt.Errorf("failed to send copy instruction: %w", err)
+			}
+			n = length
+			s.reused += length
+		}
+		position += n
+		if progressFn != nil {
+			progressFn(s.delivered(position), meta.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return bytesSent, position, err
+	}
+	s.debug("Sent %d bytes of %s, the receiver copied %d", bytesSent, meta.Filename, s.reused)
+	return bytesSent, position, nil
+}
+
+// openBase opens the file a delta transfer of rel builds on: what is at the
+// announced path in the destination, if it is a regular file
+func openBase(destDir, rel string) *os.File {
+	basePath, err := safeJoin(destDir, rel)
+	if err != nil {
+		return nil
+	}
+	if info, err := os.Lstat(basePath); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	base, err := os.Open(basePath)
+	if err != nil {
+		return nil
+	}
+	return base
+}
+
+// signBase answers a delta transfer with the signature of base, or an
+// empty one when there is none
+func (r *Receiver) signBase(base *os.File) (delta.Signature, error) {
+	var sig delta.Signature
+	if base != nil {
+		info, err := base.Stat()
+		if err != nil {
+			return sig, fmt.Errorf("failed to stat %s: %w", base.Name(), err)
+		}
+		if sig, err = delta.Sign(base, delta.BlockSizeFor(info.Size())); err != nil {
+			return sig, fmt.Errorf("failed to read %s: %w", base.Name(), err)
+		}
+		r.debugLog("Signed %d blocks of %s for a delta transfer", len(sig.Blocks), base.Name())
+	}
+	msg, err := NewSignatureMessage(sig)
+	if err != nil {
+		return sig, err
+	}
+	if err := r.send(msg); err != nil {
+		r.debugLog("Failed to send signature: %v", err)
+	}
+	return sig, nil
+}
@@ -0,0 +1,102 @@
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Entry is one item of a batch: a regular file, a directory or a symlink
+type Entry struct {
+	LocalPath  string // where the entry lives on this machine
+	RelPath    string // slash-separated path the receiver recreates
+	IsDir      bool
+	Mode       fs.FileMode // permission bits
+	ModTime    time.Time
+	LinkTarget string // slash-separated target for symlinks found inside directories
+	Size       int64
+	Checksum   string // SHA-256 hex, filled in once computed
+}
+
+// CollectEntries expands the given paths into batch entries. Files keep their
+// base name, directories are walked and every entry below them is named
+// relative to the directory's parent, so `pulse send ./project` recreates
+// project/ on the other side. Directories are listed before their contents.
+// Symlinks given as arguments are followed, those inside directories are
+// kept as links.
+func CollectEntries(paths []string) ([]Entry, error) {
+	var entries []Entry
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, fmt.Errorf("file not found: %s", root)
+		}
+		if !info.IsDir() {
+			entries = append(entries, Entry{
+				LocalPath: root,
+				RelPath:   filepath.Base(root),
+				Mode:      info.Mode().Perm(),
+				ModTime:   info.ModTime(),
+				Size:      info.Size(),
+			})
+			continue
+		}
+
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		base := filepath.Dir(abs)
+		err = filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Sockets and devices have no portable meaning on the receiving
+			// side
+			isLink := d.Type()&fs.ModeSymlink != 0
+			if !d.IsDir() && !d.Type().IsRegular() && !isLink {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(base, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			entry := Entry{
+				LocalPath: path,
+				RelPath:   filepath.ToSlash(rel),
+				IsDir:     d.IsDir(),
+				Mode:      info.Mode().Perm(),
+				ModTime:   info.ModTime(),
+				Size:      entrySize(info),
+			}
+			if isLink {
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				entry.LinkTarget = filepath.ToSlash(target)
+				entry.Mode = 0
+				entry.Size = 0
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s: %w", root, err)
+		}
+	}
+	return entries, nil
+}
+
+func entrySize(info fs.FileInfo) int64 {
+	if info.IsDir() {
+		return 0
+	}
+	return info.Size()
+}
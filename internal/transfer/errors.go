@@ -0,0 +1,28 @@
+package transfer
+
+import "fmt"
+
+// PeerError is a failure the other side reported, such as a refused file,
+// or its decision to cancel the transfer
+type PeerError struct {
+	Peer      string // "sender" or "receiver"
+	Reason    string
+	Cancelled bool
+}
+
+func (e *PeerError) Error() string {
+	if e.Cancelled {
+		return fmt.Sprintf("%s cancelled transfer: %s", e.Peer, e.Reason)
+	}
+	return fmt.Sprintf("%s error: %s", e.Peer, e.Reason)
+}
+
+// ChecksumError means the data that arrived is not what was sent
+type ChecksumError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
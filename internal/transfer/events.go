@@ -0,0 +1,138 @@
+package transfer
+
+import "time"
+
+// Observer receives the events of a transfer as they happen. It is called
+// on the transfer's goroutine, so it should return quickly.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc adapts a function to Observer
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) Observe(e Event) { f(e) }
+
+// Event is one of the *Event types below
+type Event interface {
+	event()
+}
+
+// Phase is a stage of a transfer
+type Phase string
+
+const (
+	PhaseConnecting   Phase = "connecting"   // dialing the relay
+	PhaseWaiting      Phase = "waiting"      // for the other side to join
+	PhaseHashing      Phase = "hashing"      // computing checksums before sending
+	PhaseTransferring Phase = "transferring" // moving the data of an entry
+	PhaseVerifying    Phase = "verifying"    // checking or waiting for the checksum of an entry
+	PhaseReconnecting Phase = "reconnecting" // after the connection dropped
+	PhaseDone         Phase = "done"
+)
+
+// PhaseEvent marks the start of a new phase
+type PhaseEvent struct {
+	Phase Phase
+}
+
+// PeerJoinedEvent means the other side joined the room, or rejoined it
+// after reconnecting
+type PeerJoinedEvent struct{}
+
+// FileStartEvent is sent when an entry is announced. Index is its position
+// in the batch.
+type FileStartEvent struct {
+	Index    int
+	Metadata Metadata
+}
+
+// ProgressEvent is a throughput sample, sent at most every sampleInterval
+// and once the entry is complete. Total is -1 for streams of unknown length.
+type ProgressEvent struct {
+	Index int
+	Bytes int64
+	Total int64
+	Speed float64 // bytes/sec since the entry started
+}
+
+// FileEndEvent is sent when an entry is done, with Err set if it failed
+type FileEndEvent struct {
+	Index    int
+	Metadata Metadata
+	Stats    Stats
+	Err      error
+}
+
+// RetryEvent is sent before another attempt after a failure, such as a
+// dropped connection
+type RetryEvent struct {
+	Attempt int // 1 for the first retry
+	Max     int
+	Err     error
+}
+
+// ErrorEvent is sent when a transfer fails for good
+type ErrorEvent struct {
+	Err error
+}
+
+// RecipientEvent carries an event of one receiver of a Broadcast. Events of
+// the broadcast as a whole, such as hashing the batch, are not wrapped.
+type RecipientEvent struct {
+	Recipient int // 0 for the first receiver
+	Event     Event
+}
+
+func (PhaseEvent) event()      {}
+func (PeerJoinedEvent) event() {}
+func (FileStartEvent) event()  {}
+func (ProgressEvent) event()   {}
+func (FileEndEvent) event()    {}
+func (RetryEvent) event()      {}
+func (ErrorEvent) event()      {}
+func (RecipientEvent) event()  {}
+
+const sampleInterval = 100 * time.Millisecond
+
+// emit passes e to the configured observer, if any
+func (c Config) emit(e Event) {
+	if c.Observer != nil {
+		c.Observer.Observe(e)
+	}
+}
+
+// finish reports how a public operation ended
+func (c Config) finish(err error) {
+	if err != nil {
+		c.emit(ErrorEvent{Err: err})
+	} else {
+		c.emit(PhaseEvent{Phase: PhaseDone})
+	}
+}
+
+// metered wraps progressFn so it also emits progress events for the entry
+// at index
+func (c Config) metered(index int, progressFn func(done, total int64)) func(done, total int64) {
+	if c.Observer == nil {
+		return progressFn
+	}
+	start := time.Now()
+	var last time.Time
+	var lastBytes int64
+	return func(done, total int64) {
+		if progressFn != nil {
+			progressFn(done, total)
+		}
+		now := time.Now()
+		if now.Sub(last) < sampleInterval && (done != total || done == lastBytes) {
+			return
+		}
+		var speed float64
+		if elapsed := now.Sub(start); elapsed > 0 {
+			speed = float64(done) / elapsed.Seconds()
+		}
+		c.emit(ProgressEvent{Index: index, Bytes: done, Total: total, Speed: speed})
+		last, lastBytes = now, done
+	}
+}
@@ -0,0 +1,101 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the wire protocol spoken by this package. It changes
+// whenever peers of different versions could misread each other's messages.
+const ProtocolVersion = 1
+
+// MaxChunkSize is the largest chunk payload a receiver accepts
+const MaxChunkSize = 4 * 1024 * 1024
+
+// Capabilities a peer can announce in its hello
+const (
+	CapResume  = "resume"  // offers checkpoints and continues files after reconnecting
+	CapVerify  = "verify"  // answers every completed file with a checksum message
+	CapDeflate = "deflate" // handles compressed chunks
+	CapSymlink = "symlink" // recreates symlink entries
+	CapDedup   = "dedup"   // answers batch manifests with the files it already has
+	CapDelta   = "delta"   // sends signatures of existing files and applies copy instructions
+)
+
+// HashSHA256 is the checksum algorithm every peer supports
+const HashSHA256 = "sha256"
+
+var ErrVersionMismatch = errors.New("protocol version mismatch")
+
+// Hello describes what a peer supports. It is part of every ready message.
+type Hello struct {
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Hashes       []string `json:"hashes,omitempty"`
+	MaxChunkSize int      `json:"max_chunk_size,omitempty"`
+}
+
+// Has reports whether the hello lists the capability
+func (h Hello) Has(capability string) bool {
+	return contains(h.Capabilities, capability)
+}
+
+// Negotiate returns what both peers support: the shared capabilities, the
+// first common hash in local's order of preference and the smaller chunk
+// limit. Peers on another protocol version are refused.
+func Negotiate(local, remote Hello) (Hello, error) {
+	switch {
+	case remote.Version == 0:
+		return Hello{}, fmt.Errorf("%w: the other side does not announce a version, update it to a current Pulse release", ErrVersionMismatch)
+	case remote.Version > local.Version:
+		return Hello{}, fmt.Errorf("%w: the other side speaks version %d and this side %d, update this side", ErrVersionMismatch, remote.Version, local.Version)
+	case remote.Version < local.Version:
+		return Hello{}, fmt.Errorf("%w: the other side speaks version %d and this side %d, update the other side", ErrVersionMismatch, remote.Version, local.Version)
+	}
+
+	common := Hello{Version: local.Version, MaxChunkSize: local.MaxChunkSize}
+	for _, c := range local.Capabilities {
+		if remote.Has(c) {
+			common.Capabilities = append(common.Capabilities, c)
+		}
+	}
+	for _, h := range local.Hashes {
+		if contains(remote.Hashes, h) {
+			common.Hashes = []string{h}
+			break
+		}
+	}
+	if len(common.Hashes) == 0 {
+		return Hello{}, fmt.Errorf("no common checksum algorithm: this side supports %v, the other side %v", local.Hashes, remote.Hashes)
+	}
+	if remote.MaxChunkSize > 0 && (common.MaxChunkSize == 0 || remote.MaxChunkSize < common.MaxChunkSize) {
+		common.MaxChunkSize = remote.MaxChunkSize
+	}
+	return common, nil
+}
+
+// capabilityFor names the capability the sender needs to have negotiated
+// before sending each type of message
+var capabilityFor = map[MessageType]string{
+	MsgTypeCompressedChunk: CapDeflate,
+	MsgTypeManifest:        CapDedup,
+	MsgTypeCopy:            CapDelta,
+}
+
+// checkNegotiated refuses messages of a type that needs a capability the
+// session does not have
+func checkNegotiated(session Hello, msgType MessageType) error {
+	if capability, ok := capabilityFor[msgType]; ok && !session.Has(capability) {
+		return refuse("the sender used %s without negotiating it", capability)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
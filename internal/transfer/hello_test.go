@@ -0,0 +1,117 @@
+package transfer
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := Hello{
+		Version:      ProtocolVersion,
+		Capabilities: []string{CapResume, CapVerify, CapDeflate},
+		Hashes:       []string{"blake3", HashSHA256},
+		MaxChunkSize: 1 << 20,
+	}
+	tests := []struct {
+		name        string
+		remote      Hello
+		want        Hello
+		wantErr     bool
+		wantVersion bool // the error is a version mismatch
+	}{
+		{
+			name:   "same",
+			remote: local,
+			want:   Hello{Version: ProtocolVersion, Capabilities: local.Capabilities, Hashes: []string{"blake3"}, MaxChunkSize: 1 << 20},
+		},
+		{
+			name:   "common capabilities in local order",
+			remote: Hello{Version: ProtocolVersion, Capabilities: []string{CapDelta, CapDeflate, CapResume}, Hashes: []string{HashSHA256}},
+			want:   Hello{Version: ProtocolVersion, Capabilities: []string{CapResume, CapDeflate}, Hashes: []string{HashSHA256}, MaxChunkSize: 1 << 20},
+		},
+		{
+			name:   "no capabilities",
+			remote: Hello{Version: ProtocolVersion, Hashes: []string{HashSHA256}},
+			want:   Hello{Version: ProtocolVersion, Hashes: []string{HashSHA256}, MaxChunkSize: 1 << 20},
+		},
+		{
+			name:   "smaller chunk limit wins",
+			remote: Hello{Version: ProtocolVersion, Hashes: []string{HashSHA256}, MaxChunkSize: 64 << 10},
+			want:   Hello{Version: ProtocolVersion, Hashes: []string{HashSHA256}, MaxChunkSize: 64 << 10},
+		},
+		{
+			name:   "larger chunk limit ignored",
+			remote: Hello{Version: ProtocolVersion, Hashes: []string{HashSHA256}, MaxChunkSize: 8 << 20},
+			want:   Hello{Version: ProtocolVersion, Hashes: []string{HashSHA256}, MaxChunkSize: 1 << 20},
+		},
+		{
+			name:        "no version",
+			remote:      Hello{Hashes: []string{HashSHA256}},
+			wantErr:     true,
+			wantVersion: true,
+		},
+		{
+			name:        "newer version",
+			remote:      Hello{Version: ProtocolVersion + 1, Hashes: []string{HashSHA256}},
+			wantErr:     true,
+			wantVersion: true,
+		},
+		{
+			name:    "no common hash",
+			remote:  Hello{Version: ProtocolVersion, Hashes: []string{"md5"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Negotiate(local, tt.remote)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Negotiate = %+v, want an error", got)
+				}
+				if errors.Is(err, ErrVersionMismatch) != tt.wantVersion {
+					t.Errorf("got %v, version mismatch %v", err, tt.wantVersion)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Negotiate = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckNegotiated(t *testing.T) {
+	all := Hello{Capabilities: []string{CapDeflate, CapDedup, CapDelta}}
+	tests := []struct {
+		name    string
+		session Hello
+		msgType MessageType
+		wantErr bool
+	}{
+		{"chunk", Hello{}, MsgTypeChunk, false},
+		{"metadata", Hello{}, MsgTypeMetadata, false},
+		{"compressed negotiated", all, MsgTypeCompressedChunk, false},
+		{"compressed not negotiated", Hello{}, MsgTypeCompressedChunk, true},
+		{"manifest negotiated", all, MsgTypeManifest, false},
+		{"manifest not negotiated", Hello{Capabilities: []string{CapDeflate}}, MsgTypeManifest, true},
+		{"copy negotiated", all, MsgTypeCopy, false},
+		{"copy not negotiated", Hello{Capabilities: []string{CapDedup}}, MsgTypeCopy, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkNegotiated(tt.session, tt.msgType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkNegotiated = %v, want error %v", err, tt.wantErr)
+			}
+			var refused *refusal
+			if err != nil && !errors.As(err, &refused) {
+				t.Errorf("got %v, want a refusal the sender is told about", err)
+			}
+		})
+	}
+}
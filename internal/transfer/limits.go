@@ -0,0 +1,56 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDeclined is returned when Config.Accept turns a transfer down
+var ErrDeclined = errors.New("transfer declined")
+
+// refusal is an error the receiver reports to the sender before giving up
+type refusal struct {
+	reason string
+}
+
+func (e *refusal) Error() string {
+	return e.reason
+}
+
+func refuse(format string, args ...interface{}) error {
+	return &refusal{reason: fmt.Sprintf(format, args...)}
+}
+
+// checkSize refuses entries whose announced size breaks the limits.
+// batchBytes is what earlier files of the batch announced.
+func (r *Receiver) checkSize(meta Metadata, batchBytes int64) error {
+	if meta.Stream {
+		return nil
+	}
+	if meta.Size < 0 {
+		return refuse("invalid size %d for %s", meta.Size, meta.Filename)
+	}
+	if r.config.MaxSize > 0 && meta.Size > r.config.MaxSize {
+		return refuse("%s is %d bytes, the receiver accepts at most %d", meta.Filename, meta.Size, r.config.MaxSize)
+	}
+	if r.config.MaxTotal > 0 && batchBytes+meta.Size > r.config.MaxTotal {
+		return refuse("%s would bring the batch to %d bytes, the receiver accepts at most %d", meta.Filename, batchBytes+meta.Size, r.config.MaxTotal)
+	}
+	return nil
+}
+
+// checkFreeSpace refuses a file that does not fit on the filesystem holding
+// dir. Platforms that cannot tell are not checked.
+func checkFreeSpace(dir string, size int64) error {
+	free, err := freeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check free space: %w", err)
+	}
+	if size > free {
+		return refuse("not enough space on the receiver: %d bytes needed, %d free", size, free)
+	}
+	return nil
+}
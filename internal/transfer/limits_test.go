@@ -0,0 +1,102 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxTotal   int64
+		meta       Metadata
+		batchBytes int64
+		wantErr    bool
+	}{
+		{name: "no limits", meta: Metadata{Size: 1 << 40}},
+		{name: "below file limit", maxSize: 100, meta: Metadata{Size: 100}},
+		{name: "above file limit", maxSize: 100, meta: Metadata{Size: 101}, wantErr: true},
+		{name: "below batch limit", maxTotal: 100, meta: Metadata{Size: 40}, batchBytes: 60},
+		{name: "above batch limit", maxTotal: 100, meta: Metadata{Size: 41}, batchBytes: 60, wantErr: true},
+		{name: "file limit with batch", maxSize: 100, maxTotal: 1000, meta: Metadata{Size: 101}, wantErr: true},
+		{name: "negative size", meta: Metadata{Size: -1}, wantErr: true},
+		{name: "stream", maxSize: 100, meta: Metadata{Size: -1, Stream: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Receiver{config: Config{MaxSize: tt.maxSize, MaxTotal: tt.maxTotal}}
+			err := r.checkSize(tt.meta, tt.batchBytes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkSize() = %v, want error %v", err, tt.wantErr)
+			}
+			var ref *refusal
+			if err != nil && !errors.As(err, &ref) {
+				t.Errorf("checkSize() = %T, want a refusal the sender is told about", err)
+			}
+		})
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("free space is not known on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFreeSpace(dir, 0); err != nil {
+		t.Errorf("checkFreeSpace(0) = %v", err)
+	}
+	var ref *refusal
+	if err := checkFreeSpace(dir, free+1<<40); !errors.As(err, &ref) {
+		t.Errorf("checkFreeSpace() beyond free space = %v, want a refusal", err)
+	}
+}
+
+func TestLimitsRefuseTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxTotal int64
+	}{
+		{"file limit", 1024, 0},
+		{"batch limit", 0, 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dest := t.TempDir(), t.TempDir()
+			randomFile(t, src, "big.bin", 4096, 3)
+			_, relayURL := newTestRelay(t, 0)
+			sender, receiver := connectPeers(t, relayURL, Config{}, Config{MaxSize: tt.maxSize, MaxTotal: tt.maxTotal})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var sendErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, sendErr = sender.SendFile(ctx, filepath.Join(src, "big.bin"), nil)
+			}()
+			_, _, err := receiver.ReceiveFile(ctx, dest, nil)
+			<-done
+			if err == nil || !strings.Contains(err.Error(), "accepts at most 1024") {
+				t.Errorf("receiver: %v", err)
+			}
+			var peerErr *PeerError
+			if !errors.As(sendErr, &peerErr) || !strings.Contains(peerErr.Reason, "accepts at most 1024") {
+				t.Errorf("sender was not told why: %v", sendErr)
+			}
+			if entries, _ := os.ReadDir(dest); len(entries) > 0 {
+				t.Errorf("refused file left %s behind", entries[0].Name())
+			}
+		})
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/fromjyce/pulse/internal/delta"
 )
 
 type MessageType byte
@@ -17,25 +21,113 @@ const (
 	MsgTypeProgress MessageType = 0x11
 	MsgTypeCancel   MessageType = 0x05
 	MsgTypeChecksum MessageType = 0x06
+	MsgTypeManifest MessageType = 0x07
+	MsgTypeHave     MessageType = 0x08
+
+	// Delta transfers: the receiver answers metadata asking for it with the
+	// signature of its copy of the file, and the sender mixes chunks of
+	// literal data with copy instructions. Only used with CapDelta.
+	MsgTypeSignature MessageType = 0x09
+	MsgTypeCopy      MessageType = 0x13
+
+	// MsgTypeCompressedChunk is a chunk compressed with raw DEFLATE, only
+	// sent to receivers that announce CapDeflate
+	MsgTypeCompressedChunk MessageType = 0x12
 )
 
 type Metadata struct {
 	Filename   string `json:"filename"`
 	Size       int64  `json:"size"`
 	Chunks     int    `json:"chunks"`
-	Checksum   string `json:"checksum"`    // SHA256 hex
-	MimeType   string `json:"mime_type"`   // detected MIME type
-	BatchIndex int    `json:"batch_index"` // 0-based index in batch
-	BatchTotal int    `json:"batch_total"` // total files in batch
+	Checksum   string `json:"checksum"`              // SHA256 hex
+	MimeType   string `json:"mime_type"`             // detected MIME type
+	BatchIndex int    `json:"batch_index"`           // 0-based index in batch
+	BatchTotal int    `json:"batch_total"`           // total files in batch
+	Offset     int64  `json:"offset,omitempty"`      // byte offset the chunks start from when resuming
+	Path       string `json:"path,omitempty"`        // slash-separated path relative to the destination
+	IsDir      bool   `json:"is_dir,omitempty"`      // directory entry, carries no chunks
+	Mode       uint32 `json:"mode,omitempty"`        // permission bits
+	Stream     bool   `json:"stream,omitempty"`      // length unknown, Size is -1 and the checksum follows the last chunk
+	ModTime    int64  `json:"mtime,omitempty"`       // modification time in Unix nanoseconds
+	LinkTarget string `json:"link_target,omitempty"` // symlink entry, slash-separated target, carries no chunks
+	Text       bool   `json:"text,omitempty"`        // short UTF-8 message to show rather than save
+	Identical  bool   `json:"identical,omitempty"`   // the receiver already has this file, no chunks follow
+	Delta      bool   `json:"delta,omitempty"`       // the sender waits for a signature of the receiver's copy
+}
+
+// MaxTextSize is the longest message sent in text mode
+const MaxTextSize = 1024 * 1024
+
+// TextMimeType is announced for text messages
+const TextMimeType = "text/plain; charset=utf-8"
+
+// RelPath returns where the entry should land relative to the destination.
+// Peers that predate directory transfers only fill in Filename.
+func (m Metadata) RelPath() string {
+	if m.Path != "" {
+		return m.Path
+	}
+	return m.Filename
+}
+
+// Checkpoint describes how much of a file the receiver already holds. It
+// only lives in the receiver's memory along with the partial file, so a
+// transfer resumes within one process and starts over in a new one.
+type Checkpoint struct {
+	Checksum string `json:"checksum"`
+	Offset   int64  `json:"offset"`
 }
 
+// ReadyInfo is the optional payload of a ready message. Every ready message
+// starts a new encryption epoch. A peer that receives one without Ack starts
+// its own new epoch and answers with Ack set, since the peer may have missed
+// its earlier messages. A receiver that reconnects mid-file sets Resume so
+// the sender can continue from there. Window is how many bytes of a file the
+// receiver accepts beyond what it last reported in a progress message; zero
+// means the receiver does not report progress and the sender must not wait.
+type ReadyInfo struct {
+	Hello
+	Ack    bool        `json:"ack,omitempty"`
+	Resume *Checkpoint `json:"resume,omitempty"`
+	Window int64       `json:"window,omitempty"`
+}
+
+// Progress is sent by the receiver as it writes a file. BytesSent counts the
+// bytes of the file written so far and grants the sender credit to send up to
+// a window beyond that.
 type Progress struct {
+	BatchIndex  int   `json:"batch_index"`
 	ChunkIndex  int   `json:"chunk_index"`
 	TotalChunks int   `json:"total_chunks"`
 	BytesSent   int64 `json:"bytes_sent"`
 	TotalBytes  int64 `json:"total_bytes"`
 }
 
+// Manifest lists the files of a batch before any is sent, so the receiver
+// can name those it already has. Entries are indexed by batch index;
+// directories and symlinks are left empty.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+type ManifestEntry struct {
+	Path     string `json:"path,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Have answers a manifest with the batch indexes of the files the receiver
+// already holds with the same checksum at the same path
+type Have struct {
+	Indexes []int `json:"indexes"`
+}
+
+// Copy tells the receiver to append blocks of its copy of the file
+type Copy struct {
+	Block  int `json:"block"`
+	Blocks int `json:"blocks"`
+}
+
 type Message struct {
 	Type    MessageType
 	Payload []byte
@@ -80,10 +172,32 @@ func NewReadyMessage() Message {
 	return Message{Type: MsgTypeReady, Payload: nil}
 }
 
+func NewReadyInfoMessage(info ReadyInfo) (Message, error) {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeReady, Payload: payload}, nil
+}
+
+func NewProgressMessage(progress Progress) (Message, error) {
+	payload, err := json.Marshal(progress)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeProgress, Payload: payload}, nil
+}
+
 func NewCompleteMessage() Message {
 	return Message{Type: MsgTypeComplete, Payload: nil}
 }
 
+// NewStreamCompleteMessage ends a stream whose checksum was not known when
+// the metadata was sent
+func NewStreamCompleteMessage(checksum string) Message {
+	return Message{Type: MsgTypeComplete, Payload: []byte(checksum)}
+}
+
 func NewErrorMessage(errStr string) Message {
 	return Message{Type: MsgTypeError, Payload: []byte(errStr)}
 }
@@ -96,8 +210,104 @@ func NewChecksumMessage(checksum string) Message {
 	return Message{Type: MsgTypeChecksum, Payload: []byte(checksum)}
 }
 
+func NewManifestMessage(manifest Manifest) (Message, error) {
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeManifest, Payload: payload}, nil
+}
+
+func NewHaveMessage(have Have) (Message, error) {
+	payload, err := json.Marshal(have)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeHave, Payload: payload}, nil
+}
+
+// NewSignatureMessage describes the receiver's copy of a file. A signature
+// without blocks means there is none and the file is sent in full.
+func NewSignatureMessage(sig delta.Signature) (Message, error) {
+	payload, err := json.Marshal(sig)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeSignature, Payload: payload}, nil
+}
+
+func NewCopyMessage(c Copy) (Message, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: MsgTypeCopy, Payload: payload}, nil
+}
+
 func ParseMetadata(payload []byte) (Metadata, error) {
 	var meta Metadata
 	err := json.Unmarshal(payload, &meta)
 	return meta, err
 }
+
+func ParseManifest(payload []byte) (Manifest, error) {
+	var manifest Manifest
+	err := json.Unmarshal(payload, &manifest)
+	return manifest, err
+}
+
+func ParseHave(payload []byte) (Have, error) {
+	var have Have
+	err := json.Unmarshal(payload, &have)
+	return have, err
+}
+
+func ParseSignature(payload []byte) (delta.Signature, error) {
+	var sig delta.Signature
+	err := json.Unmarshal(payload, &sig)
+	return sig, err
+}
+
+func ParseCopy(payload []byte) (Copy, error) {
+	var c Copy
+	err := json.Unmarshal(payload, &c)
+	return c, err
+}
+
+func ParseProgress(payload []byte) (Progress, error) {
+	var progress Progress
+	err := json.Unmarshal(payload, &progress)
+	return progress, err
+}
+
+// ParseReadyInfo decodes a ready payload. Peers that predate the hello send
+// an empty payload, which yields a zero ReadyInfo.
+func ParseReadyInfo(payload []byte) (ReadyInfo, error) {
+	var info ReadyInfo
+	if len(payload) == 0 {
+		return info, nil
+	}
+	err := json.Unmarshal(payload, &info)
+	return info, err
+}
+
+// openMessage decrypts and decodes one frame. Ready messages, and only
+// those, start a new epoch, so a relay cannot splice a reconnect into the
+// middle of a stream.
+func openMessage(opener *crypto.Opener, frame []byte) (Message, error) {
+	decrypted, isNewEpoch, err := opener.Open(frame)
+	if errors.Is(err, crypto.ErrWrongDirection) && opener.IsUnsequenced(frame) {
+		return Message{}, fmt.Errorf("%w: the other side runs a Pulse release from before the version handshake", ErrVersionMismatch)
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	msg, err := DecodeMessage(decrypted)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to decode message: %w", err)
+	}
+	if isNewEpoch != (msg.Type == MsgTypeReady) {
+		return Message{}, fmt.Errorf("failed to decrypt message: %w", crypto.ErrOutOfOrder)
+	}
+	return msg, nil
+}
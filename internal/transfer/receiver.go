@@ -2,151 +2,701 @@ package transfer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
+	"unicode/utf8"
 
-	"github.com/gorilla/websocket"
 	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/fromjyce/pulse/internal/delta"
+	"github.com/gorilla/websocket"
 )
 
+// ReceivedFile describes one file delivered as part of a batch
+type ReceivedFile struct {
+	Path     string
+	Metadata Metadata
+	Stats    Stats
+	Conflict string // ActionRenamed, ActionOverwritten, ActionSkipped or ActionIdentical if the path existed
+}
+
 type Receiver struct {
 	relayURL string
 	token    string
 	key      []byte
 	conn     *websocket.Conn
-	debug    bool
+	config   Config
+	sealer   *crypto.Sealer
+	opener   *crypto.Opener
+	session  Hello // what both sides support, from the sender's last ready message
+	// resyncing is set after reconnecting, until the sender starts a new
+	// epoch. Whatever it sent before then may have gaps and is dropped.
+	resyncing bool
 }
 
 func NewReceiver(relayURL, token string, key []byte) *Receiver {
-	return &Receiver{relayURL: relayURL, token: token, key: key}
+	return NewReceiverWithConfig(relayURL, token, key, Config{})
 }
 
 func NewReceiverWithDebug(relayURL, token string, key []byte, debug bool) *Receiver {
-	return &Receiver{relayURL: relayURL, token: token, key: key, debug: debug}
+	return NewReceiverWithConfig(relayURL, token, key, Config{Debug: debug})
+}
+
+func NewReceiverWithConfig(relayURL, token string, key []byte, cfg Config) *Receiver {
+	cfg = cfg.withDefaults()
+	return &Receiver{relayURL: relayURL, token: token, key: key, config: cfg}
 }
 
 func (r *Receiver) debugLog(msg string, args ...interface{}) {
-	if r.debug {
-		fmt.Printf("[DEBUG] "+msg+"\n", args...)
+	if r.config.Logf != nil {
+		r.config.Logf(msg, args...)
 	}
 }
 
-func (r *Receiver) Connect() error {
-	url := fmt.Sprintf("%s/ws/%s", r.relayURL, r.token)
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+func (r *Receiver) send(msg Message) error {
+	encrypted, err := r.sealer.Seal(EncodeMessage(msg))
 	if err != nil {
-		return fmt.Errorf("failed to connect to relay: %w", err)
+		return fmt.Errorf("failed to encrypt message: %w", err)
 	}
-	r.conn = conn
+	return r.conn.WriteMessage(websocket.BinaryMessage, encrypted)
+}
 
-	readyMsg := NewReadyMessage()
-	encryptedReady, err := crypto.EncryptChunk(EncodeMessage(readyMsg), r.key)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt ready message: %w", err)
+// hello describes this receiver to the sender
+func (r *Receiver) hello() Hello {
+	capabilities := []string{CapResume, CapVerify, CapDeflate, CapDedup, CapDelta}
+	if r.config.Preserve {
+		capabilities = append(capabilities, CapSymlink)
+	}
+	return Hello{
+		Version:      ProtocolVersion,
+		Capabilities: capabilities,
+		Hashes:       []string{HashSHA256},
+		MaxChunkSize: MaxChunkSize,
 	}
+}
 
-	if err := r.conn.WriteMessage(websocket.BinaryMessage, encryptedReady); err != nil {
+// sendReady starts a new epoch and announces the receiver, including a
+// checkpoint when a file is partially written so the sender can resume it
+func (r *Receiver) sendReady(info ReadyInfo) error {
+	info.Hello = r.hello()
+	info.Window = r.config.Window
+	sealer, err := crypto.NewSealer(r.key, crypto.DirectionToSender)
+	if err != nil {
+		return err
+	}
+	r.sealer = sealer
+	readyMsg, err := NewReadyInfoMessage(info)
+	if err != nil {
+		return err
+	}
+	if err := r.send(readyMsg); err != nil {
 		return fmt.Errorf("failed to send ready message: %w", err)
 	}
+	return nil
+}
+
+// Connect joins the relay and announces the receiver, until ctx is done
+func (r *Receiver) Connect(ctx context.Context) error {
+	r.config.emit(PhaseEvent{Phase: PhaseConnecting})
+	if err := r.connect(ctx); err != nil {
+		r.config.emit(ErrorEvent{Err: err})
+		return err
+	}
+	r.config.emit(PhaseEvent{Phase: PhaseWaiting})
+	return nil
+}
+
+func (r *Receiver) connect(ctx context.Context) error {
+	opener, err := crypto.NewOpener(r.key, crypto.DirectionToReceiver)
+	if err != nil {
+		return err
+	}
+	r.opener = opener
+
+	url := fmt.Sprintf("%s/ws/%s", r.relayURL, r.token)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	r.conn = conn
+
+	if err := r.sendReady(ReadyInfo{}); err != nil {
+		return err
+	}
 
 	r.debugLog("Receiver connected and ready")
 	return nil
 }
 
+// reconnect re-dials the relay after the connection dropped, using the same
+// retry policy as the sender
+func (r *Receiver) reconnect(ctx context.Context, resume *Checkpoint) error {
+	r.conn.Close()
+	var lastErr error
+	for attempt := 0; attempt < r.config.Retries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(attempt*2) * time.Second
+			r.debugLog("Reconnect failed, retrying in %v: %v", backoff, lastErr)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+		r.debugLog("Reconnect attempt %d/%d", attempt+1, r.config.Retries)
+		url := fmt.Sprintf("%s/ws/%s", r.relayURL, r.token)
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		r.conn = conn
+		if err := r.sendReady(ReadyInfo{Resume: resume}); err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		r.resyncing = true
+		return nil
+	}
+	return fmt.Errorf("failed to reconnect to relay after %d attempts: %w", r.config.Retries, lastErr)
+}
+
 func (r *Receiver) ReceiveFile(ctx context.Context, destDir string, progressFn func(received, total int64)) (string, Stats, error) {
-	startTime := time.Now()
-	stats := Stats{}
+	file, err := r.receiveFile(ctx, newConflicts(destDir, r.config), 0, 1, 0, progressFn)
+	if err == nil {
+		r.finishDirs([]ReceivedFile{file})
+	}
+	r.config.finish(err)
+	return file.Path, file.Stats, err
+}
 
-	var metadata Metadata
-	var file *os.File
-	var bytesReceived int64
-	var destPath string
-	var fileContent []byte
+// ReceiveBatch keeps reading until every file the sender announced in the
+// batch has arrived. Peers that leave the batch fields empty, such as the
+// phone page, are treated as sending a single file.
+func (r *Receiver) ReceiveBatch(ctx context.Context, destDir string, progressFn func(index int, received, total int64)) ([]ReceivedFile, error) {
+	files, err := r.receiveBatch(ctx, destDir, progressFn)
+	r.config.finish(err)
+	return files, err
+}
 
-	defer func() {
-		if file != nil {
-			file.Close()
+func (r *Receiver) receiveBatch(ctx context.Context, destDir string, progressFn func(index int, received, total int64)) ([]ReceivedFile, error) {
+	var files []ReceivedFile
+	batchTotal := 1
+	var batchBytes int64
+	conflicts := newConflicts(destDir, r.config)
+	for len(files) < batchTotal {
+		index := len(files)
+		var fileProgress func(received, total int64)
+		if progressFn != nil {
+			fileProgress = func(received, total int64) { progressFn(index, received, total) }
 		}
-	}()
 
-	for {
-		select {
-		case <-ctx.Done():
-			// Context cancelled, clean up and return
-			if file != nil {
-				os.Remove(destPath)
+		file, err := r.receiveFile(ctx, conflicts, index, batchTotal, batchBytes, fileProgress)
+		if err != nil {
+			return files, err
+		}
+		meta := file.Metadata
+		if file.Conflict != ActionIdentical {
+			batchBytes += meta.Size
+		}
+		if index == 0 && meta.BatchTotal > 1 {
+			batchTotal = meta.BatchTotal
+		}
+		r.debugLog("Received batch file %d/%d: %s", index+1, batchTotal, file.Path)
+		files = append(files, file)
+	}
+	r.finishDirs(files)
+	return files, nil
+}
+
+// finishDirs applies the modes and modification times of received
+// directories under Preserve. It runs once their contents are written, since
+// that changes both, deepest directories first.
+func (r *Receiver) finishDirs(files []ReceivedFile) {
+	if !r.config.Preserve {
+		return
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if !f.Metadata.IsDir || f.Conflict == ActionSkipped {
+			continue
+		}
+		if f.Metadata.Mode != 0 {
+			if err := os.Chmod(f.Path, os.FileMode(f.Metadata.Mode).Perm()); err != nil {
+				r.debugLog("Failed to apply mode %o to %s: %v", f.Metadata.Mode, f.Path, err)
+			}
+		}
+		if f.Metadata.ModTime != 0 {
+			if err := os.Chtimes(f.Path, time.Time{}, time.Unix(0, f.Metadata.ModTime)); err != nil {
+				r.debugLog("Failed to apply modification time to %s: %v", f.Path, err)
 			}
-			return "", stats, fmt.Errorf("transfer cancelled by receiver")
-		default:
 		}
+	}
+}
+
+// ReceiveStream receives a single file and writes its contents to w instead
+// of the filesystem, for piping into other tools. Streams cannot be rewound,
+// so a sender that restarts after a reconnect aborts the transfer.
+func (r *Receiver) ReceiveStream(ctx context.Context, w io.Writer, progressFn func(received, total int64)) (Metadata, Stats, error) {
+	open := func(meta Metadata) (target, string, error) {
+		if meta.IsDir {
+			return nil, "", fmt.Errorf("cannot write directory %s to a stream", meta.RelPath())
+		}
+		if meta.Identical {
+			return nil, "", refuse("%s must be sent in full", meta.Filename)
+		}
+		if err := r.checkSize(meta, 0); err != nil {
+			return nil, "", err
+		}
+		return &streamTarget{w: w}, "", nil
+	}
+	meta, _, stats, err := r.receiveEntry(ctx, nil, 0, open, progressFn)
+	r.config.finish(err)
+	return meta, stats, err
+}
 
-		r.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+// ReceiveText receives a single short message and returns it instead of
+// writing it anywhere. Files that are too large or not valid UTF-8 are
+// refused.
+func (r *Receiver) ReceiveText(ctx context.Context, progressFn func(received, total int64)) (string, Metadata, Stats, error) {
+	text := &textTarget{}
+	open := func(meta Metadata) (target, string, error) {
+		if meta.IsDir || meta.LinkTarget != "" || meta.Identical || meta.BatchTotal > 1 {
+			return nil, "", refuse("the receiver only accepts text")
+		}
+		if meta.Stream || meta.Size > MaxTextSize {
+			return nil, "", refuse("%s is too large to show as text, at most %d bytes are accepted", meta.Filename, MaxTextSize)
+		}
+		return text, "", nil
+	}
+	meta, _, stats, err := r.receiveEntry(ctx, nil, 0, open, progressFn)
+	if err == nil && !utf8.Valid(text.buf.Bytes()) {
+		err = fmt.Errorf("%s is not text", meta.Filename)
+	}
+	r.config.finish(err)
+	if err != nil {
+		return "", meta, stats, err
+	}
+	return text.buf.String(), meta, stats, nil
+}
 
-		_, encryptedData, err := r.conn.ReadMessage()
+// receiveFile receives entry index of a batch into the destination.
+// batchTotal is the size of the batch the first entry announced and
+// batchBytes what earlier files of the batch announced.
+func (r *Receiver) receiveFile(ctx context.Context, conflicts *conflicts, index, batchTotal int, batchBytes int64, progressFn func(received, total int64)) (ReceivedFile, error) {
+	var action string
+	open := func(meta Metadata) (target, string, error) {
+		if index > 0 && meta.BatchTotal != batchTotal {
+			return nil, "", refuse("batch size changed from %d to %d", batchTotal, meta.BatchTotal)
+		}
+		if meta.Identical {
+			if !conflicts.isIdentical(meta.RelPath()) {
+				return nil, "", refuse("%s is not on the receiver yet", meta.RelPath())
+			}
+			action = ActionIdentical
+			destPath, err := safeJoin(conflicts.destDir, meta.RelPath())
+			return nil, destPath, err
+		}
+		if err := r.checkSize(meta, batchBytes); err != nil {
+			return nil, "", err
+		}
+		rel, resolved, err := conflicts.resolve(meta)
 		if err != nil {
-			if file != nil {
-				os.Remove(destPath)
+			return nil, "", err
+		}
+		action = resolved
+		destPath, err := safeJoin(conflicts.destDir, rel)
+		if err != nil {
+			return nil, "", err
+		}
+		if action != "" {
+			r.debugLog("%s already exists: %s", meta.RelPath(), action)
+		}
+		if action == ActionSkipped {
+			if meta.IsDir {
+				return nil, destPath, nil
+			}
+			return discardTarget{}, destPath, nil
+		}
+		if meta.LinkTarget != "" {
+			if !r.config.Preserve {
+				return nil, "", fmt.Errorf("sender sent symlink %s without being asked to", meta.RelPath())
+			}
+			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+				return nil, "", fmt.Errorf("failed to create directory: %w", err)
 			}
-			return "", stats, fmt.Errorf("failed to read message: %w", err)
+			if err := createSymlink(meta.LinkTarget, destPath); err != nil {
+				return nil, "", err
+			}
+			return nil, destPath, nil
+		}
+		if meta.IsDir {
+			// Keep directories writable for the owner so the files that
+			// follow can be created inside them
+			if err := os.MkdirAll(destPath, os.FileMode(meta.Mode)|0700); err != nil {
+				return nil, "", fmt.Errorf("failed to create directory: %w", err)
+			}
+			return nil, destPath, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return nil, "", fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := checkFreeSpace(filepath.Dir(destPath), meta.Size); err != nil {
+			return nil, "", err
 		}
+		out, err := newFileTarget(destPath, r.config.Preserve, r.debugLog)
+		if err != nil {
+			return nil, "", err
+		}
+		if meta.Delta {
+			out.base = openBase(conflicts.destDir, meta.RelPath())
+		}
+		return out, destPath, nil
+	}
+	meta, destPath, stats, err := r.receiveEntry(ctx, conflicts, index, open, progressFn)
+	return ReceivedFile{Path: destPath, Metadata: meta, Stats: stats, Conflict: action}, err
+}
+
+// nextMessage reads, decrypts and decodes the next message. When the
+// connection drops it reconnects and offers the checkpoint for resumption.
+// Cancelling ctx closes the connection, so a pending read returns at once.
+func (r *Receiver) nextMessage(ctx context.Context, reconnects *int, resume *Checkpoint) (Message, error) {
+	for {
+		if ctx.Err() != nil {
+			return Message{}, fmt.Errorf("transfer cancelled by receiver")
+		}
+
+		r.conn.SetReadDeadline(time.Now().Add(r.config.Timeout))
 
-		decrypted, err := crypto.DecryptChunk(encryptedData, r.key)
+		conn := r.conn
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		_, encryptedData, err := conn.ReadMessage()
+		stop()
 		if err != nil {
-			if file != nil {
-				os.Remove(destPath)
+			if ctx.Err() != nil {
+				return Message{}, fmt.Errorf("transfer cancelled by receiver")
 			}
-			return "", stats, fmt.Errorf("failed to decrypt message: %w", err)
+			if *reconnects < r.config.Retries {
+				*reconnects++
+				r.debugLog("Connection lost (%v), reconnecting", err)
+				r.config.emit(RetryEvent{Attempt: *reconnects, Max: r.config.Retries, Err: err})
+				r.config.emit(PhaseEvent{Phase: PhaseReconnecting})
+				if err = r.reconnect(ctx, resume); err == nil {
+					continue
+				}
+			}
+			return Message{}, fmt.Errorf("failed to read message: %w", err)
 		}
 
-		msg, err := DecodeMessage(decrypted)
-		if err != nil {
-			if file != nil {
-				os.Remove(destPath)
+		msg, err := openMessage(r.opener, encryptedData)
+		if r.resyncing {
+			if errors.Is(err, crypto.ErrOutOfOrder) || (err == nil && msg.Type != MsgTypeReady) {
+				r.debugLog("Dropping message sent before the reconnect")
+				continue
 			}
-			return "", stats, fmt.Errorf("failed to decode message: %w", err)
+			r.resyncing = false
+		}
+		return msg, err
+	}
+}
+
+// sendProgress reports how much of the current file has been written, which
+// also lets the sender continue past its window
+func (r *Receiver) sendProgress(progress Progress) {
+	msg, err := NewProgressMessage(progress)
+	if err == nil {
+		err = r.send(msg)
+	}
+	if err != nil {
+		// A dropped connection shows up on the next read
+		r.debugLog("Failed to send progress: %v", err)
+	}
+}
+
+// receiveEntry runs the message loop for entry index of a batch. open is
+// called with the entry's metadata and returns where its chunks should go, or
+// a nil target for entries without content such as directories. A batch
+// manifest is checked against dest, which is nil when not receiving into a
+// directory.
+func (r *Receiver) receiveEntry(ctx context.Context, dest *conflicts, index int, open func(Metadata) (target, string, error), progressFn func(received, total int64)) (Metadata, string, Stats, error) {
+	startTime := time.Now()
+	stats := Stats{}
+
+	var metadata Metadata
+	var out target
+	var bytesReceived int64
+	var chunksReceived int
+	// bytesGranted is the progress last reported to the sender
+	var bytesGranted int64
+	var destPath string
+	var hasher *crypto.Hasher
+	// sig describes base, the receiver's copy of the file in delta transfers
+	var sig delta.Signature
+	var base *os.File
+	started := false
+	// After either side reconnected, chunks sent in the meantime may be lost,
+	// so nothing more is written until the sender confirms where to resume
+	awaitingResume := false
+	reconnects := 0
+
+	// written accounts for n more bytes of the file and grants the sender
+	// more credit when enough has been written
+	written := func(n int64) {
+		bytesReceived += n
+		chunksReceived++
+		if bytesReceived-bytesGranted >= r.config.Window/4 {
+			r.sendProgress(Progress{
+				BatchIndex:  metadata.BatchIndex,
+				ChunkIndex:  chunksReceived,
+				TotalChunks: metadata.Chunks,
+				BytesSent:   bytesReceived,
+				TotalBytes:  metadata.Size,
+			})
+			bytesGranted = bytesReceived
+		}
+		if progressFn != nil {
+			progressFn(bytesReceived, metadata.Size)
+		}
+	}
+
+	fail := func(err error) (Metadata, string, Stats, error) {
+		var refused *refusal
+		if errors.As(err, &refused) {
+			r.send(NewErrorMessage(refused.reason))
+		}
+		if out != nil {
+			out.Abort()
+		}
+		if started {
+			r.config.emit(FileEndEvent{Index: metadata.BatchIndex, Metadata: metadata, Stats: stats, Err: err})
+		}
+		return metadata, "", stats, err
+	}
+
+	for {
+		// Offer a checkpoint only when there is something the sender could
+		// identify and resume
+		var resume *Checkpoint
+		if out != nil && metadata.Checksum != "" {
+			resume = &Checkpoint{Checksum: metadata.Checksum, Offset: bytesReceived}
+		}
+
+		previousReconnects := reconnects
+		msg, err := r.nextMessage(ctx, &reconnects, resume)
+		if err != nil {
+			return fail(err)
+		}
+		if reconnects != previousReconnects && out != nil {
+			awaitingResume = true
+		}
+		if err := checkNegotiated(r.session, msg.Type); err != nil {
+			return fail(err)
 		}
 
 		switch msg.Type {
+		case MsgTypeReady:
+			info, err := ParseReadyInfo(msg.Payload)
+			if err != nil {
+				return fail(fmt.Errorf("failed to parse ready message: %w", err))
+			}
+			r.config.emit(PeerJoinedEvent{})
+			if !info.Ack {
+				// The sender (re)joined the room and may have missed our
+				// earlier messages, so start over with a fresh epoch
+				if out != nil {
+					awaitingResume = true
+				}
+				if err := r.sendReady(ReadyInfo{Ack: true, Resume: resume}); err != nil {
+					r.debugLog("Failed to answer ready message: %v", err)
+				}
+			}
+			session, err := Negotiate(r.hello(), info.Hello)
+			if err != nil {
+				r.send(NewErrorMessage(err.Error()))
+				return fail(err)
+			}
+			r.session = session
+			r.debugLog("Negotiated protocol v%d, capabilities %v, hash %s", session.Version, session.Capabilities, session.Hashes[0])
+
+		case MsgTypeManifest:
+			manifest, err := ParseManifest(msg.Payload)
+			if err != nil {
+				return fail(fmt.Errorf("failed to parse manifest: %w", err))
+			}
+			have := Have{Indexes: dest.checkManifest(manifest)}
+			r.debugLog("Already have %d of the %d batch entries", len(have.Indexes), len(manifest.Entries))
+			haveMsg, err := NewHaveMessage(have)
+			if err != nil {
+				return fail(err)
+			}
+			if err := r.send(haveMsg); err != nil {
+				r.debugLog("Failed to answer manifest: %v", err)
+			}
+
 		case MsgTypeMetadata:
-			metadata, err = ParseMetadata(msg.Payload)
+			meta, err := ParseMetadata(msg.Payload)
 			if err != nil {
-				return "", stats, fmt.Errorf("failed to parse metadata: %w", err)
+				return fail(fmt.Errorf("failed to parse metadata: %w", err))
 			}
+			if out != nil && meta.Checksum != "" && meta.Checksum == metadata.Checksum {
+				// Sender reconnected and is resending this file
+				if meta.Offset != 0 && meta.Offset != bytesReceived {
+					return fail(fmt.Errorf("cannot resume at offset %d, have %d bytes", meta.Offset, bytesReceived))
+				}
+				if meta.Offset == 0 && bytesReceived > 0 {
+					r.debugLog("Sender restarted %s from the beginning", meta.Filename)
+					if err := out.Rewind(); err != nil {
+						return fail(err)
+					}
+					bytesReceived = 0
+					chunksReceived = 0
+					hasher = crypto.NewHasher()
+				}
+				bytesGranted = bytesReceived
+				r.debugLog("Resuming %s at %d bytes", meta.Filename, bytesReceived)
+				awaitingResume = false
+				continue
+			}
+			if meta.Offset != 0 {
+				return fail(fmt.Errorf("sender asked to resume %s at offset %d without a checkpoint", meta.Filename, meta.Offset))
+			}
+			if started {
+				return fail(fmt.Errorf("sender restarted %s and it cannot be resumed", metadata.Filename))
+			}
+			started = true
+			metadata = meta
+			if err := sanitizeMetadata(&metadata); err != nil {
+				r.send(NewErrorMessage("invalid file name"))
+				return fail(err)
+			}
+			r.config.emit(FileStartEvent{Index: metadata.BatchIndex, Metadata: metadata})
 			r.debugLog("Received metadata: %s (%d bytes, checksum: %s)", metadata.Filename, metadata.Size, metadata.Checksum)
-			destPath = filepath.Join(destDir, metadata.Filename)
-			file, err = os.Create(destPath)
+			if metadata.Delta && !r.session.Has(CapDelta) {
+				return fail(refuse("the sender used %s without negotiating it", CapDelta))
+			}
+			// Entry numbers come from the sender, so they are checked before
+			// anything is written. Whatever arrives first is asked about.
+			if metadata.BatchIndex != index {
+				return fail(refuse("expected batch file %d, got %d", index+1, metadata.BatchIndex+1))
+			}
+			if index == 0 && r.config.Accept != nil && !r.config.Accept(metadata) {
+				r.send(NewCancelMessage("declined by the receiver"))
+				return fail(ErrDeclined)
+			}
+			// Time spent deciding does not count against the speed
+			startTime = time.Now()
+			out, destPath, err = open(metadata)
+			if err != nil {
+				return fail(err)
+			}
+			if out != nil {
+				hasher = crypto.NewHasher()
+				progressFn = r.config.metered(metadata.BatchIndex, progressFn)
+				r.config.emit(PhaseEvent{Phase: PhaseTransferring})
+			}
+			if metadata.Delta {
+				if sig, err = r.signBase(baseOf(out)); err != nil {
+					return fail(err)
+				}
+				if len(sig.Blocks) > 0 {
+					base = baseOf(out)
+				}
+			}
+
+		case MsgTypeChunk, MsgTypeCompressedChunk:
+			if out == nil {
+				return fail(fmt.Errorf("received chunk before metadata"))
+			}
+			if awaitingResume {
+				return fail(fmt.Errorf("sender continued %s after a reconnect without resuming", metadata.Filename))
+			}
+			if len(msg.Payload) > MaxChunkSize {
+				return fail(fmt.Errorf("chunk of %d bytes exceeds the %d byte limit", len(msg.Payload), MaxChunkSize))
+			}
+			data := msg.Payload
+			if msg.Type == MsgTypeCompressedChunk {
+				if data, err = decompressChunk(msg.Payload); err != nil {
+					return fail(err)
+				}
+			}
+			if !metadata.Stream && bytesReceived+int64(len(data)) > metadata.Size {
+				return fail(refuse("%s is larger than the %d bytes announced", metadata.Filename, metadata.Size))
+			}
+			if metadata.Stream && r.config.MaxSize > 0 && bytesReceived+int64(len(data)) > r.config.MaxSize {
+				return fail(refuse("%s exceeds the %d byte limit of the receiver", metadata.Filename, r.config.MaxSize))
+			}
+			n, err := out.Write(data)
 			if err != nil {
-				return "", stats, fmt.Errorf("failed to create file: %w", err)
+				return fail(fmt.Errorf("failed to write chunk: %w", err))
 			}
-			fileContent = make([]byte, 0, metadata.Size)
+			hasher.Write(data[:n])
+			written(int64(n))
 
-		case MsgTypeChunk:
-			if file == nil {
-				return "", stats, fmt.Errorf("received chunk before metadata")
+		case MsgTypeCopy:
+			if base == nil {
+				return fail(fmt.Errorf("received copy instruction without a base file"))
+			}
+			if awaitingResume {
+				return fail(fmt.Errorf("sender continued %s after a reconnect without resuming", metadata.Filename))
 			}
-			n, err := file.Write(msg.Payload)
+			c, err := ParseCopy(msg.Payload)
 			if err != nil {
-				os.Remove(destPath)
-				return "", stats, fmt.Errorf("failed to write chunk: %w", err)
+				return fail(fmt.Errorf("failed to parse copy instruction: %w", err))
 			}
-			fileContent = append(fileContent, msg.Payload...)
-			bytesReceived += int64(n)
-			if progressFn != nil {
-				progressFn(bytesReceived, metadata.Size)
+			offset, length, err := sig.Range(c.Block, c.Blocks)
+			if err != nil {
+				return fail(refuse("invalid copy instruction for %s", metadata.Filename))
+			}
+			if bytesReceived+length > metadata.Size {
+				return fail(refuse("%s is larger than the %d bytes announced", metadata.Filename, metadata.Size))
+			}
+			n, err := io.Copy(io.MultiWriter(out, hasher), io.NewSectionReader(base, offset, length))
+			if err != nil {
+				return fail(fmt.Errorf("failed to copy from %s: %w", base.Name(), err))
 			}
+			written(n)
 
 		case MsgTypeComplete:
-			// Verify checksum
-			if metadata.Checksum != "" {
+			if awaitingResume {
+				return fail(fmt.Errorf("sender completed %s after a reconnect without resuming", metadata.Filename))
+			}
+			if out != nil && !metadata.Stream && bytesReceived != metadata.Size {
+				return fail(refuse("received %d of the %d bytes announced for %s", bytesReceived, metadata.Size, metadata.Filename))
+			}
+			// Streams of unknown length carry their checksum at the end
+			expected := metadata.Checksum
+			if len(msg.Payload) > 0 {
+				expected = string(msg.Payload)
+			}
+			var computedChecksum string
+			if hasher != nil {
+				computedChecksum = hasher.Sum()
+			}
+			if expected != "" && hasher != nil {
+				r.config.emit(PhaseEvent{Phase: PhaseVerifying})
 				r.debugLog("Verifying checksum...")
-				computedChecksum := crypto.ComputeChecksum(fileContent)
-				if computedChecksum != metadata.Checksum {
-					os.Remove(destPath)
-					return "", stats, fmt.Errorf("checksum mismatch: expected %s, got %s", metadata.Checksum, computedChecksum)
+				if computedChecksum != expected {
+					r.send(NewErrorMessage("checksum mismatch"))
+					return fail(&ChecksumError{Expected: expected, Actual: computedChecksum})
 				}
 				r.debugLog("Checksum verified ✓")
+				metadata.Checksum = expected
+				stats.Verified = true
+			}
+			if out != nil {
+				if err := out.Commit(metadata); err != nil {
+					r.send(NewErrorMessage("failed to save file"))
+					return fail(err)
+				}
+				// Tell the sender what was written, so it only reports
+				// success once the file is saved
+				if err := r.send(NewChecksumMessage(computedChecksum)); err != nil {
+					r.debugLog("Failed to confirm checksum: %v", err)
+				}
 			}
 
 			duration := time.Since(startTime)
@@ -155,17 +705,17 @@ func (r *Receiver) ReceiveFile(ctx context.Context, destDir string, progressFn f
 			stats.Duration = duration
 			stats.BytesSent = bytesReceived
 			stats.Speed = speed
+			stats.Checksum = computedChecksum
 
 			r.debugLog("Transfer complete: %d bytes in %v (%.0f bytes/sec)", bytesReceived, duration, speed)
-			return destPath, stats, nil
+			r.config.emit(FileEndEvent{Index: metadata.BatchIndex, Metadata: metadata, Stats: stats})
+			return metadata, destPath, stats, nil
 
 		case MsgTypeCancel:
-			os.Remove(destPath)
-			return "", stats, fmt.Errorf("sender cancelled transfer: %s", string(msg.Payload))
+			return fail(&PeerError{Peer: "sender", Reason: string(msg.Payload), Cancelled: true})
 
 		case MsgTypeError:
-			os.Remove(destPath)
-			return "", stats, fmt.Errorf("sender error: %s", string(msg.Payload))
+			return fail(&PeerError{Peer: "sender", Reason: string(msg.Payload)})
 		}
 	}
 }
@@ -0,0 +1,168 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameLength is the longest file name most filesystems accept, in bytes
+const maxNameLength = 255
+
+// reservedNames cannot be used as file names on Windows, with or without an
+// extension. They are refused everywhere so a transfer behaves the same on
+// every platform.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeMetadata replaces the names the peer announced with safe ones
+func sanitizeMetadata(meta *Metadata) error {
+	var rel string
+	var err error
+	if meta.Path != "" {
+		rel, err = SanitizePath(meta.Path)
+	} else {
+		rel, err = SanitizeFilename(meta.Filename)
+	}
+	if err != nil {
+		return err
+	}
+	meta.Path = rel
+	meta.Filename = path.Base(rel)
+	if meta.LinkTarget != "" {
+		return checkLinkTarget(rel, meta.LinkTarget)
+	}
+	return nil
+}
+
+// checkLinkTarget refuses symlinks that are absolute or lead outside the
+// destination, relative to the link's own directory
+func checkLinkTarget(rel, target string) error {
+	if strings.HasPrefix(target, "/") || strings.HasPrefix(target, `\`) || hasDriveLetter(target) {
+		return fmt.Errorf("refusing symlink %s to absolute path %q", rel, target)
+	}
+	if !utf8.ValidString(target) || strings.IndexFunc(target, func(r rune) bool { return unicode.IsControl(r) || isBidiControl(r) }) >= 0 {
+		return fmt.Errorf("refusing symlink %s with invalid target %q", rel, target)
+	}
+	resolved := path.Join(path.Dir(rel), strings.ReplaceAll(target, `\`, "/"))
+	if !filepath.IsLocal(filepath.FromSlash(resolved)) {
+		return fmt.Errorf("refusing symlink %s pointing outside destination: %q", rel, target)
+	}
+	return nil
+}
+
+// SanitizeFilename turns a file name announced by the peer into a single
+// safe path element. Anything up to the last separator is dropped.
+func SanitizeFilename(name string) (string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return sanitizeElement(parts[len(parts)-1])
+}
+
+// SanitizePath turns a slash-separated path announced by the peer into a
+// safe relative path. Absolute paths are refused, "." and ".." elements
+// are dropped and every remaining element is checked like a file name.
+func SanitizePath(p string) (string, error) {
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, `\`) || hasDriveLetter(p) {
+		return "", fmt.Errorf("refusing absolute path %q", p)
+	}
+	var clean []string
+	for _, part := range splitPath(p) {
+		elem, err := sanitizeElement(part)
+		if err != nil {
+			return "", err
+		}
+		clean = append(clean, elem)
+	}
+	if len(clean) == 0 {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return strings.Join(clean, "/"), nil
+}
+
+// splitPath splits on both separators, since a backslash is one on Windows,
+// and drops the elements that do not name anything
+func splitPath(p string) []string {
+	var parts []string
+	for _, part := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part != "." && part != ".." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func hasDriveLetter(p string) bool {
+	return len(p) >= 2 && p[1] == ':' && ((p[0] >= 'a' && p[0] <= 'z') || (p[0] >= 'A' && p[0] <= 'Z'))
+}
+
+func sanitizeElement(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("file name %q is not valid UTF-8", name)
+	}
+	// Peers may send decomposed forms, as macOS does; NFC keeps names that
+	// look the same from ending up as different files
+	name = norm.NFC.String(name)
+	if len(name) > maxNameLength {
+		return "", fmt.Errorf("file name %q is longer than %d bytes", name, maxNameLength)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || isBidiControl(r) {
+			return "", fmt.Errorf("file name %q contains control characters", name)
+		}
+		if runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*`, r) {
+			return "", fmt.Errorf("file name %q contains characters Windows does not allow", name)
+		}
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return "", fmt.Errorf("file name %q is reserved", name)
+	}
+	return name, nil
+}
+
+// isBidiControl reports characters that reorder how a name is displayed,
+// which can disguise a file's extension
+func isBidiControl(r rune) bool {
+	return (r >= '\u202A' && r <= '\u202E') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// safeJoin joins a sanitized relative path onto destDir, refusing to go
+// through symlinks that already exist below destDir, since those could point
+// anywhere
+func safeJoin(destDir, rel string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("refusing to write outside destination: %s", rel)
+	}
+	destPath := filepath.Join(destDir, filepath.FromSlash(rel))
+	current := destDir
+	for _, part := range strings.Split(rel, "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect %s: %w", current, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to write through symlink %s", current)
+		}
+	}
+	return destPath, nil
+}
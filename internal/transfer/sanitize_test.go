@@ -0,0 +1,176 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "docs/report.pdf", "docs/report.pdf", false},
+		{"backslashes", `docs\report.pdf`, "docs/report.pdf", false},
+		{"dot elements", "./docs/./report.pdf", "docs/report.pdf", false},
+		{"leading dotdot", "../../etc/passwd", "etc/passwd", false},
+		{"inner dotdot", "docs/../../report.pdf", "docs/report.pdf", false},
+		{"backslash dotdot", `..\..\boot.ini`, "boot.ini", false},
+		{"decomposed", "cafe\u0301.txt", "caf\u00e9.txt", false},
+		{"reserved prefix", "CONSOLE.txt", "CONSOLE.txt", false},
+		{"only dotdot", "../..", "", true},
+		{"empty", "", "", true},
+		{"absolute", "/etc/passwd", "", true},
+		{"absolute backslash", `\Windows\System32`, "", true},
+		{"UNC", `\\server\share\file`, "", true},
+		{"drive letter", "C:/Windows/win.ini", "", true},
+		{"drive relative", "c:evil.exe", "", true},
+		{"reserved", "CON", "", true},
+		{"reserved lowercase", "docs/nul", "", true},
+		{"reserved with extension", "aux.txt", "", true},
+		{"reserved with trailing space", "COM1 .txt", "", true},
+		{"bidi override", "invoice\u202Efdp.exe", "", true},
+		{"bidi isolate", "docs/\u2066report.pdf", "", true},
+		{"control character", "report\n.pdf", "", true},
+		{"NUL", "report\x00.pdf", "", true},
+		{"invalid UTF-8", "report\xff.pdf", "", true},
+		{"too long", strings.Repeat("a", maxNameLength+1), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizePath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("SanitizePath(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SanitizePath(%q): %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "report.pdf", "report.pdf", false},
+		{"path", "docs/report.pdf", "report.pdf", false},
+		{"absolute", "/etc/passwd", "passwd", false},
+		{"windows path", `C:\Users\me\report.pdf`, "report.pdf", false},
+		{"dotdot", "..", "", true},
+		{"reserved", "PRN.log", "", true},
+		{"bidi", "\u202Bphoto.jpg", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeFilename(tt.file)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("SanitizeFilename(%q) = %q, want an error", tt.file, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SanitizeFilename(%q): %v", tt.file, err)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeFilename(%q) = %q, want %q", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLinkTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		rel     string
+		target  string
+		wantErr bool
+	}{
+		{"sibling", "dir/link", "file", false},
+		{"parent inside", "dir/link", "../file", false},
+		{"escaping", "dir/link", "../../file", true},
+		{"escaping from top", "link", "../file", true},
+		{"absolute", "link", "/etc/passwd", true},
+		{"drive letter", "link", `C:\Windows`, true},
+		{"backslash escaping", "dir/link", `..\..\file`, true},
+		{"bidi", "link", "\u202Efile", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkLinkTarget(tt.rel, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkLinkTarget(%q, %q) = %v, want error %v", tt.rel, tt.target, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dest, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "docs", "report.pdf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	symlinks := true
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		if runtime.GOOS != "windows" {
+			t.Fatal(err)
+		}
+		symlinks = false
+	}
+
+	tests := []struct {
+		name     string
+		rel      string
+		symlinks bool
+		wantErr  bool
+	}{
+		{"new file", "report.pdf", false, false},
+		{"existing file", "docs/report.pdf", false, false},
+		{"new directories", "docs/a/b/report.pdf", false, false},
+		{"dotdot", "../report.pdf", false, true},
+		{"inner dotdot", "docs/../../report.pdf", false, true},
+		{"absolute", "/etc/passwd", false, true},
+		{"symlinked parent", "link/report.pdf", true, true},
+		{"symlink itself", "link", true, true},
+		{"below symlinked parent", "link/a/b/report.pdf", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.symlinks && !symlinks {
+				t.Skip("cannot create symlinks")
+			}
+			got, err := safeJoin(dest, tt.rel)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("safeJoin(%q) = %q, want an error", tt.rel, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeJoin(%q): %v", tt.rel, err)
+			}
+			if want := filepath.Join(dest, filepath.FromSlash(tt.rel)); got != want {
+				t.Errorf("safeJoin(%q) = %q, want %q", tt.rel, got, want)
+			}
+		})
+	}
+}
@@ -2,30 +2,110 @@ package transfer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/gorilla/websocket"
 	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/fromjyce/pulse/internal/delta"
+	"github.com/gorilla/websocket"
 )
 
-const DefaultChunkSize = 64 * 1024
+const (
+	DefaultChunkSize = 64 * 1024
+	DefaultWindow    = 4 * 1024 * 1024
+)
 
 type Config struct {
 	ChunkSize int           // default 64KB
 	Timeout   time.Duration // default 5 min
-	Retries   int           // default 3
-	Debug     bool
+	Retries   int           // default 3, applies to connecting and to reconnecting mid-transfer
+	Window    int64         // bytes a receiver lets the sender run ahead, default 4MB
+	Compress  bool          // compress chunks when the receiver supports it
+	Delta     bool          // only send what changed in files the receiver already has, when it supports it
+	Debug     bool          // log to stderr unless Logf is set
+	// Logf receives debug messages, nothing is logged when it is nil
+	Logf func(format string, args ...interface{})
+	// Observer receives the events of every transfer, may be nil
+	Observer Observer
+
+	// Receiver only: what to do with entries that already exist, default
+	// ConflictRename. Ask is called with the existing path under
+	// ConflictAsk and returns one of the other policies.
+	OnConflict ConflictPolicy
+	Ask        func(path string) ConflictPolicy
+	// Receiver only: apply modification times and exact directory modes,
+	// and accept symlinks
+	Preserve bool
+	// Receiver only: largest file and largest batch accepted, in bytes,
+	// zero for no limit
+	MaxSize  int64
+	MaxTotal int64
+	// Receiver only: called with the first entry of every batch before
+	// anything is written. Returning false cancels the transfer with
+	// ErrDeclined. Nil accepts everything.
+	Accept func(meta Metadata) bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.ChunkSize == 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Minute
+	}
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+	if c.Window == 0 {
+		c.Window = DefaultWindow
+	}
+	if c.Debug && c.Logf == nil {
+		c.Logf = stderrLog
+	}
+	return c
 }
 
 type Stats struct {
 	Duration  time.Duration
 	BytesSent int64
 	Speed     float64 // bytes/sec
+	Verified  bool    // the other side confirmed the checksum
+	Skipped   bool    // not sent, the receiver cannot store this kind of entry
+	Identical bool    // not sent, the receiver already has the same file
+	Reused    int64   // bytes the receiver copied from its own copy in a delta transfer
+	Checksum  string  // of the content, empty for entries without any
+}
+
+func stderrLog(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "[DEBUG] "+format+"\n", args...)
+}
+
+// connError marks a failure of the relay connection itself. Those are worth
+// reconnecting for; anything else aborts the transfer.
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string { return e.err.Error() }
+func (e *connError) Unwrap() error { return e.err }
+
+// errPeerRejoined means the receiver reconnected mid-transfer and announced
+// itself with a new ready message
+var errPeerRejoined = errors.New("receiver reconnected")
+
+// inbound is a message read from the receiver during a transfer, or the
+// error that stopped reading
+type inbound struct {
+	msg Message
+	err error
 }
 
 type Sender struct {
@@ -34,33 +114,62 @@ type Sender struct {
 	key      []byte
 	conn     *websocket.Conn
 	config   Config
+	peer     ReadyInfo
+	session  Hello            // what both sides support
+	progress Progress         // last progress the receiver reported for the current file
+	verified string           // checksum the receiver confirmed for the current file
+	have     *Have            // answer to the last manifest
+	sig      *delta.Signature // the receiver's copy of the current file, in delta transfers
+	reused   int64            // bytes of the current file the receiver copied
+	inbox    chan inbound
+	sealer   *crypto.Sealer
+	opener   *crypto.Opener
+	// recipients is set on the lanes of a broadcast, which the relay pairs
+	// with one receiver each
+	recipients int
 }
 
 func NewSender(relayURL, token string, key []byte, cfg Config) *Sender {
-	if cfg.ChunkSize == 0 {
-		cfg.ChunkSize = DefaultChunkSize
-	}
-	if cfg.Timeout == 0 {
-		cfg.Timeout = 5 * time.Minute
-	}
-	if cfg.Retries == 0 {
-		cfg.Retries = 3
-	}
-	return &Sender{relayURL: relayURL, token: token, key: key, config: cfg}
+	return &Sender{relayURL: relayURL, token: token, key: key, config: cfg.withDefaults()}
 }
 
 func (s *Sender) debug(msg string, args ...interface{}) {
-	if s.config.Debug {
-		fmt.Printf("[DEBUG] "+msg+"\n", args...)
+	if s.config.Logf != nil {
+		s.config.Logf(msg, args...)
+	}
+}
+
+// Connect joins the relay, retrying with a backoff until ctx is done
+func (s *Sender) Connect(ctx context.Context) error {
+	s.config.emit(PhaseEvent{Phase: PhaseConnecting})
+	err := s.connect(ctx)
+	if err != nil {
+		s.config.emit(ErrorEvent{Err: err})
 	}
+	return err
 }
 
-func (s *Sender) Connect() error {
+func (s *Sender) connect(ctx context.Context) error {
+	if s.opener == nil {
+		opener, err := crypto.NewOpener(s.key, crypto.DirectionToSender)
+		if err != nil {
+			return err
+		}
+		s.opener = opener
+	}
+
+	url := fmt.Sprintf("%s/ws/%s", s.relayURL, s.token)
+	if s.recipients > 0 {
+		url += fmt.Sprintf("?recipients=%d", s.recipients)
+	}
 	var lastErr error
 	for attempt := 0; attempt < s.config.Retries; attempt++ {
 		s.debug("Connect attempt %d/%d", attempt+1, s.config.Retries)
-		url := fmt.Sprintf("%s/ws/%s", s.relayURL, s.token)
-		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		conn, resp, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if err == nil && s.recipients > 0 && resp.Header.Get("X-Pulse-Recipients") == "" {
+			conn.Close()
+			return errors.New("the relay cannot send to several recipients, it needs to be updated")
+		}
 		if err == nil {
 			s.conn = conn
 			s.debug("Connected successfully")
@@ -70,72 +179,620 @@ func (s *Sender) Connect() error {
 		if attempt < s.config.Retries-1 {
 			backoff := time.Duration((attempt+1)*2) * time.Second
 			s.debug("Connection failed, retrying in %v: %v", backoff, err)
-			time.Sleep(backoff)
+			s.config.emit(RetryEvent{Attempt: attempt + 1, Max: s.config.Retries - 1, Err: err})
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
 		}
 	}
 	return fmt.Errorf("failed to connect to relay after %d attempts: %w", s.config.Retries, lastErr)
 }
 
-func (s *Sender) WaitForReceiver(timeout time.Duration) error {
-	s.conn.SetReadDeadline(time.Now().Add(timeout))
-	defer s.conn.SetReadDeadline(time.Time{})
+func (s *Sender) send(msg Message) error {
+	encrypted, err := s.sealer.Seal(EncodeMessage(msg))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, encrypted); err != nil {
+		return &connError{err}
+	}
+	return nil
+}
 
-	_, message, err := s.conn.ReadMessage()
+// hello describes this sender to the receiver
+func (s *Sender) hello() Hello {
+	return Hello{
+		Version:      ProtocolVersion,
+		Capabilities: []string{CapResume, CapVerify, CapDeflate, CapSymlink, CapDedup, CapDelta},
+		Hashes:       []string{HashSHA256},
+		MaxChunkSize: MaxChunkSize,
+	}
+}
+
+// negotiate settles on what both sides support after the receiver announced
+// itself
+func (s *Sender) negotiate() error {
+	session, err := Negotiate(s.hello(), s.peer.Hello)
 	if err != nil {
-		return fmt.Errorf("timeout waiting for receiver: %w", err)
+		return err
+	}
+	s.session = session
+	s.debug("Negotiated protocol v%d, capabilities %v, hash %s, max chunk %d", session.Version, session.Capabilities, session.Hashes[0], session.MaxChunkSize)
+	return nil
+}
+
+// compressorFor returns a compressor when chunks of the given MIME type
+// should be compressed, or nil to send them as they are
+func (s *Sender) compressorFor(mimeType string) *compressor {
+	if !s.config.Compress {
+		return nil
+	}
+	if !s.session.Has(CapDeflate) {
+		s.debug("Receiver does not support compression, sending uncompressed")
+		return nil
+	}
+	if !compressible(mimeType) {
+		s.debug("Not compressing %s, it is already compressed", mimeType)
+		return nil
+	}
+	return newCompressor()
+}
+
+// chunkMessage wraps a chunk, compressing it when a compressor is in use
+func chunkMessage(comp *compressor, data []byte) Message {
+	if comp == nil {
+		return NewChunkMessage(data)
+	}
+	return comp.chunkMessage(data)
+}
+
+// chunkSize is the configured chunk size, capped to what the receiver accepts
+func (s *Sender) chunkSize() int {
+	if s.session.MaxChunkSize > 0 && s.session.MaxChunkSize < s.config.ChunkSize {
+		return s.session.MaxChunkSize
 	}
+	return s.config.ChunkSize
+}
 
-	decrypted, err := crypto.DecryptChunk(message, s.key)
+// sendReady starts a new epoch with a ready message
+func (s *Sender) sendReady(info ReadyInfo) error {
+	info.Hello = s.hello()
+	sealer, err := crypto.NewSealer(s.key, crypto.DirectionToReceiver)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt ready message: %w", err)
+		return err
+	}
+	s.sealer = sealer
+	readyMsg, err := NewReadyInfoMessage(info)
+	if err != nil {
+		return err
 	}
+	if err := s.send(readyMsg); err != nil {
+		return fmt.Errorf("failed to send ready message: %w", err)
+	}
+	return nil
+}
 
-	msg, err := DecodeMessage(decrypted)
+// WaitForReceiver blocks until the receiver joined, for at most timeout or
+// until ctx is done
+func (s *Sender) WaitForReceiver(ctx context.Context, timeout time.Duration) error {
+	s.config.emit(PhaseEvent{Phase: PhaseWaiting})
+	err := s.waitForReceiver(ctx, timeout)
 	if err != nil {
+		s.config.emit(ErrorEvent{Err: err})
+	}
+	return err
+}
+
+func (s *Sender) waitForReceiver(ctx context.Context, timeout time.Duration) error {
+	// A receiver that joined the room before us has already sent its ready
+	// message into the void, so ask it to repeat it.
+	if err := s.sendReady(ReadyInfo{}); err != nil {
 		return err
 	}
+
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+	conn := s.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var msg Message
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("stopped waiting for receiver: %w", ctx.Err())
+			}
+			return fmt.Errorf("timeout waiting for receiver: %w", err)
+		}
+
+		msg, err = openMessage(s.opener, message)
+		if errors.Is(err, crypto.ErrOutOfOrder) {
+			// Left over from before we reconnected
+			s.debug("Dropping stale message while waiting for receiver")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Type != MsgTypeProgress {
+			break
+		}
+	}
 	if msg.Type != MsgTypeReady {
 		return fmt.Errorf("unexpected message type: %d", msg.Type)
 	}
-	s.debug("Receiver ready")
+	var err error
+	s.peer, err = ParseReadyInfo(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse ready message: %w", err)
+	}
+	if !s.peer.Ack {
+		// The receiver joined after our probe, which it never saw
+		if err := s.sendReady(ReadyInfo{Ack: true}); err != nil {
+			return err
+		}
+	}
+	if err := s.negotiate(); err != nil {
+		return err
+	}
+	s.debug("Receiver ready (window %d bytes)", s.peer.Window)
+	s.config.emit(PeerJoinedEvent{})
+	s.startReading()
 	return nil
 }
 
+// startReading reads the receiver's messages in the background for the rest
+// of the connection. The transfer loop picks them up from the inbox, so all
+// writes stay on one goroutine.
+func (s *Sender) startReading() {
+	inbox := make(chan inbound, 16)
+	s.inbox = inbox
+	conn, opener := s.conn, s.opener
+	go func() {
+		defer close(inbox)
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				inbox <- inbound{err: &connError{err}}
+				return
+			}
+			msg, err := openMessage(opener, frame)
+			inbox <- inbound{msg: msg, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// drainInbox waits for the reading goroutine to stop once the connection is
+// closed, so the opener can be used again
+func (s *Sender) drainInbox() {
+	if s.inbox == nil {
+		return
+	}
+	for range s.inbox {
+	}
+	s.inbox = nil
+}
+
+// handle processes one message from the receiver
+func (s *Sender) handle(in inbound, ok bool) error {
+	if !ok {
+		return &connError{errors.New("connection closed")}
+	}
+	if in.err != nil {
+		return in.err
+	}
+	switch in.msg.Type {
+	case MsgTypeProgress:
+		progress, err := ParseProgress(in.msg.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse progress: %w", err)
+		}
+		if progress.BatchIndex == s.progress.BatchIndex && progress.BytesSent > s.progress.BytesSent {
+			s.progress = progress
+		}
+	case MsgTypeChecksum:
+		s.verified = string(in.msg.Payload)
+	case MsgTypeHave:
+		have, err := ParseHave(in.msg.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse manifest answer: %w", err)
+		}
+		s.have = &have
+	case MsgTypeSignature:
+		sig, err := ParseSignature(in.msg.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse signature: %w", err)
+		}
+		s.sig = &sig
+	case MsgTypeReady:
+		info, err := ParseReadyInfo(in.msg.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse ready message: %w", err)
+		}
+		if info.Ack {
+			return nil
+		}
+		s.peer = info
+		if err := s.sendReady(ReadyInfo{Ack: true}); err != nil {
+			return err
+		}
+		if err := s.negotiate(); err != nil {
+			return err
+		}
+		s.config.emit(PeerJoinedEvent{})
+		return errPeerRejoined
+	case MsgTypeCancel:
+		return &PeerError{Peer: "receiver", Reason: string(in.msg.Payload), Cancelled: true}
+	case MsgTypeError:
+		return &PeerError{Peer: "receiver", Reason: string(in.msg.Payload)}
+	}
+	return nil
+}
+
+// poll handles the messages that arrived so far without blocking
+func (s *Sender) poll() error {
+	for {
+		select {
+		case in, ok := <-s.inbox:
+			if err := s.handle(in, ok); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// waitForCredit blocks until the receiver's window has room for data beyond
+// position. Receivers that advertise no window are not waited for.
+func (s *Sender) waitForCredit(ctx context.Context, position int64) error {
+	if err := s.poll(); err != nil {
+		return err
+	}
+	if s.peer.Window <= 0 || position-s.progress.BytesSent < s.peer.Window {
+		return nil
+	}
+	s.debug("Waiting for receiver at %d bytes, it has %d", position, s.progress.BytesSent)
+	timer := time.NewTimer(s.config.Timeout)
+	defer timer.Stop()
+	for position-s.progress.BytesSent >= s.peer.Window {
+		select {
+		case in, ok := <-s.inbox:
+			if err := s.handle(in, ok); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return errors.New("timeout waiting for receiver to catch up")
+		}
+	}
+	return nil
+}
+
+// reconnect re-establishes the relay connection after it dropped mid-file and
+// returns the offset the receiver wants the file resumed from.
+func (s *Sender) reconnect(ctx context.Context, meta Metadata) (int64, error) {
+	s.conn.Close()
+	s.drainInbox()
+	if err := s.connect(ctx); err != nil {
+		return 0, err
+	}
+	if err := s.waitForReceiver(ctx, s.config.Timeout); err != nil {
+		return 0, err
+	}
+	return s.resumeOffset(meta), nil
+}
+
+// delivered is how much of the current file to report as done: what the
+// receiver wrote, or what was sent for receivers that do not report progress
+func (s *Sender) delivered(position int64) int64 {
+	if s.peer.Window > 0 {
+		return s.progress.BytesSent
+	}
+	return position
+}
+
+// awaitChecksum waits for the receiver to confirm the checksum of the file
+// that was just completed, reporting its progress in the meantime. Receivers
+// that do not confirm checksums are not waited for.
+func (s *Sender) awaitChecksum(ctx context.Context, checksum string, position, total int64, progressFn func(sent, total int64)) (bool, error) {
+	if !s.session.Has(CapVerify) {
+		return false, nil
+	}
+	s.config.emit(PhaseEvent{Phase: PhaseVerifying})
+	timer := time.NewTimer(s.config.Timeout)
+	defer timer.Stop()
+	for s.verified == "" {
+		select {
+		case in, ok := <-s.inbox:
+			if err := s.handle(in, ok); err != nil {
+				return false, err
+			}
+			if progressFn != nil && s.verified == "" {
+				progressFn(s.delivered(position), total)
+			}
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timer.C:
+			return false, errors.New("timeout waiting for receiver to confirm checksum")
+		}
+	}
+	if s.verified != checksum {
+		return false, &ChecksumError{Expected: checksum, Actual: s.verified}
+	}
+	if progressFn != nil {
+		progressFn(position, total)
+	}
+	s.debug("Receiver confirmed checksum %s", checksum)
+	return true, nil
+}
+
+// resumeOffset picks where to continue meta from, based on the checkpoint
+// the receiver announced when it (re)joined
+func (s *Sender) resumeOffset(meta Metadata) int64 {
+	cp := s.peer.Resume
+	if !s.session.Has(CapResume) || cp == nil || cp.Checksum != meta.Checksum || cp.Offset < 0 || cp.Offset > meta.Size {
+		s.debug("Receiver has no usable checkpoint, restarting %s", meta.Filename)
+		return 0
+	}
+	s.debug("Receiver has %d/%d bytes of %s, resuming", cp.Offset, meta.Size, meta.Filename)
+	return cp.Offset
+}
+
 func (s *Sender) SendFile(ctx context.Context, filePath string, progressFn func(sent, total int64)) (Stats, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	entry := Entry{LocalPath: filePath, RelPath: filepath.Base(filePath), Mode: stat.Mode().Perm(), ModTime: stat.ModTime(), Size: stat.Size()}
+	stats, err := s.sendFile(ctx, entry, 0, 1, progressFn)
+	s.config.finish(err)
+	return stats, err
+}
+
+// SendBatch sends several entries over the current connection, tagging each
+// with its position so the receiver knows when the batch is finished.
+// Symlinks are skipped when the receiver cannot store them, and so are
+// files it already has. On error the stats of the entries already delivered
+// are returned.
+func (s *Sender) SendBatch(ctx context.Context, entries []Entry, progressFn func(index int, sent, total int64)) ([]Stats, error) {
+	allStats, err := s.sendBatch(ctx, entries, progressFn)
+	s.config.finish(err)
+	return allStats, err
+}
+
+func (s *Sender) sendBatch(ctx context.Context, entries []Entry, progressFn func(index int, sent, total int64)) ([]Stats, error) {
+	total := 0
+	for _, entry := range entries {
+		if s.canSend(entry) {
+			total++
+		}
+	}
+	entries = append([]Entry(nil), entries...)
+	identical, err := s.exchangeManifest(ctx, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	allStats := make([]Stats, 0, len(entries))
+	batchIndex := 0
+	for i, entry := range entries {
+		if !s.canSend(entry) {
+			s.debug("Receiver does not store symlinks, skipping %s", entry.RelPath)
+			allStats = append(allStats, Stats{Skipped: true})
+			continue
+		}
+		s.debug("Sending entry %d/%d: %s", batchIndex+1, total, entry.RelPath)
+		var fileProgress func(sent, total int64)
+		if progressFn != nil {
+			index := i
+			fileProgress = func(sent, total int64) { progressFn(index, sent, total) }
+		}
+		var stats Stats
+		var err error
+		if identical[batchIndex] {
+			s.debug("Receiver already has %s", entry.RelPath)
+			err = s.sendBare(entry, batchIndex, total)
+			stats.Identical = true
+			stats.Checksum = entry.Checksum
+		} else if entry.IsDir || entry.LinkTarget != "" {
+			err = s.sendBare(entry, batchIndex, total)
+		} else {
+			stats, err = s.sendFile(ctx, entry, batchIndex, total, fileProgress)
+		}
+		batchIndex++
+		if err != nil {
+			return allStats, err
+		}
+		allStats = append(allStats, stats)
+	}
+	return allStats, nil
+}
+
+// SendStream sends everything read from r as a single file of unknown
+// length, hashing it on the fly. Unlike files, streams cannot be resumed
+// after the connection drops.
+func (s *Sender) SendStream(ctx context.Context, r io.Reader, name string, progressFn func(sent, total int64)) (Stats, error) {
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	meta := Metadata{
+		Filename:   name,
+		Size:       -1,
+		MimeType:   mimeType,
+		BatchIndex: 0,
+		BatchTotal: 1,
+		Stream:     true,
+	}
+
+	s.config.emit(FileStartEvent{Index: 0, Metadata: meta})
+	stats, err := s.sendStream(ctx, r, meta, s.config.metered(0, progressFn))
+	s.config.emit(FileEndEvent{Index: 0, Metadata: meta, Stats: stats, Err: err})
+	s.config.finish(err)
+	return stats, err
+}
+
+func (s *Sender) sendStream(ctx context.Context, r io.Reader, meta Metadata, progressFn func(sent, total int64)) (Stats, error) {
 	startTime := time.Now()
 	stats := Stats{}
 
-	file, err := os.Open(filePath)
+	metaMsg, err := NewMetadataMessage(meta)
 	if err != nil {
-		return stats, fmt.Errorf("failed to open file: %w", err)
+		return stats, err
 	}
-	defer file.Close()
+	if err := s.send(metaMsg); err != nil {
+		return stats, fmt.Errorf("failed to send metadata: %w", err)
+	}
+	s.config.emit(PhaseEvent{Phase: PhaseTransferring})
 
-	stat, err := file.Stat()
+	hasher := crypto.NewHasher()
+	buf := make([]byte, s.chunkSize())
+	comp := s.compressorFor(meta.MimeType)
+	var bytesSent int64
+	s.progress = Progress{}
+	s.verified = ""
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.send(NewCancelMessage("cancelled by sender"))
+			return stats, ctx.Err()
+		default:
+		}
+
+		if err := s.waitForCredit(ctx, bytesSent); err != nil {
+			if ctx.Err() != nil {
+				s.send(NewCancelMessage("cancelled by sender"))
+			}
+			if errors.Is(err, errPeerRejoined) {
+				return stats, errors.New("receiver reconnected, streams cannot be resumed")
+			}
+			return stats, err
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			if err := s.send(chunkMessage(comp, buf[:n])); err != nil {
+				return stats, fmt.Errorf("failed to send chunk, streams cannot be resumed: %w", err)
+			}
+			bytesSent += int64(n)
+			if progressFn != nil {
+				progressFn(s.delivered(bytesSent), -1)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			s.send(NewErrorMessage("failed to read input"))
+			return stats, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+
+	checksum := hasher.Sum()
+	s.debug("Stream checksum: %s", checksum)
+	if err := s.send(NewStreamCompleteMessage(checksum)); err != nil {
+		return stats, fmt.Errorf("failed to send complete message: %w", err)
+	}
+	stats.Verified, err = s.awaitChecksum(ctx, checksum, bytesSent, -1, progressFn)
 	if err != nil {
-		return stats, fmt.Errorf("failed to stat file: %w", err)
+		return stats, err
+	}
+
+	duration := time.Since(startTime)
+	stats.Duration = duration
+	stats.BytesSent = bytesSent
+	stats.Speed = float64(bytesSent) / duration.Seconds()
+	stats.Checksum = checksum
+
+	s.debug("Stream complete: %d bytes in %v", bytesSent, duration)
+	return stats, nil
+}
+
+// canSend reports whether the receiver can store the entry
+func (s *Sender) canSend(entry Entry) bool {
+	return entry.LinkTarget == "" || s.session.Has(CapSymlink)
+}
+
+// sendBare announces an entry that carries no chunks: a directory, so empty
+// ones survive the transfer too, a symlink, or a file the receiver already
+// has
+func (s *Sender) sendBare(entry Entry, batchIndex, batchTotal int) (err error) {
+	meta := Metadata{
+		Filename:   path.Base(entry.RelPath),
+		Path:       entry.RelPath,
+		IsDir:      entry.IsDir,
+		Mode:       uint32(entry.Mode),
+		ModTime:    modTime(entry.ModTime),
+		LinkTarget: entry.LinkTarget,
+		Identical:  !entry.IsDir && entry.LinkTarget == "",
+		Size:       entry.Size,
+		Checksum:   entry.Checksum,
+		BatchIndex: batchIndex,
+		BatchTotal: batchTotal,
 	}
+	s.config.emit(FileStartEvent{Index: batchIndex, Metadata: meta})
+	defer func() {
+		s.config.emit(FileEndEvent{Index: batchIndex, Metadata: meta, Stats: Stats{Identical: meta.Identical, Checksum: meta.Checksum}, Err: err})
+	}()
 
-	// Compute checksum
-	s.debug("Computing checksum for %s", stat.Name())
-	checksumData, err := io.ReadAll(file)
+	// A receiver that rejoined between entries has nothing to resume
+	if err := s.poll(); err != nil && !errors.Is(err, errPeerRejoined) {
+		return err
+	}
+	metaMsg, err := NewMetadataMessage(meta)
 	if err != nil {
-		return stats, fmt.Errorf("failed to read file for checksum: %w", err)
+		return err
+	}
+	if err := s.send(metaMsg); err != nil {
+		return fmt.Errorf("failed to send metadata: %w", err)
 	}
-	checksum := crypto.ComputeChecksum(checksumData)
-	s.debug("Checksum: %s", checksum)
+	if err := s.send(NewCompleteMessage()); err != nil {
+		return fmt.Errorf("failed to send complete message: %w", err)
+	}
+	return nil
+}
 
-	// Reset file pointer
-	if _, err := file.Seek(0, 0); err != nil {
-		return stats, fmt.Errorf("failed to seek file: %w", err)
+func (s *Sender) sendFile(ctx context.Context, entry Entry, batchIndex, batchTotal int, progressFn func(sent, total int64)) (Stats, error) {
+	file, err := os.Open(entry.LocalPath)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to open file: %w", err)
 	}
+	defer file.Close()
 
-	filename := filepath.Base(filePath)
-	fileSize := stat.Size()
-	totalChunks := int((fileSize + int64(s.config.ChunkSize) - 1) / int64(s.config.ChunkSize))
+	stat, err := file.Stat()
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	entry.Size = stat.Size()
+	return s.sendReader(ctx, file, entry, batchIndex, batchTotal, progressFn)
+}
+
+// SendReader sends content as the file described by entry, whose Size must
+// match the content. Like files, it is resumed after reconnecting.
+func (s *Sender) SendReader(ctx context.Context, content io.ReadSeeker, entry Entry, progressFn func(sent, total int64)) (Stats, error) {
+	stats, err := s.sendReader(ctx, content, entry, 0, 1, progressFn)
+	s.config.finish(err)
+	return stats, err
+}
+
+func (s *Sender) sendReader(ctx context.Context, content io.ReadSeeker, entry Entry, batchIndex, batchTotal int, progressFn func(sent, total int64)) (Stats, error) {
+	filename := path.Base(entry.RelPath)
+	fileSize := entry.Size
+	chunkSize := int64(s.chunkSize())
+	totalChunks := int((fileSize + chunkSize - 1) / chunkSize)
 
 	// Detect MIME type
-	mimeType := mime.TypeByExtension(filepath.Ext(filePath))
+	mimeType := mime.TypeByExtension(filepath.Ext(filename))
 	if mimeType == "" {
 		mimeType = "application/octet-stream"
 	}
@@ -144,89 +801,229 @@ func (s *Sender) SendFile(ctx context.Context, filePath string, progressFn func(
 		Filename:   filename,
 		Size:       fileSize,
 		Chunks:     totalChunks,
-		Checksum:   checksum,
+		Checksum:   entry.Checksum,
 		MimeType:   mimeType,
+		BatchIndex: batchIndex,
+		BatchTotal: batchTotal,
+		Path:       entry.RelPath,
+		Mode:       uint32(entry.Mode),
+		ModTime:    modTime(entry.ModTime),
+		Delta:      s.config.Delta && s.session.Has(CapDelta),
+	}
+	return s.sendContent(ctx, content, meta, progressFn)
+}
+
+// SendText sends a short message, such as a URL or a snippet, that the
+// receiver shows instead of saving
+func (s *Sender) SendText(ctx context.Context, text string, progressFn func(sent, total int64)) (Stats, error) {
+	if len(text) > MaxTextSize {
+		return Stats{}, fmt.Errorf("text is %d bytes, at most %d can be sent as text", len(text), MaxTextSize)
+	}
+	if !utf8.ValidString(text) {
+		return Stats{}, errors.New("text is not valid UTF-8")
+	}
+	chunkSize := s.chunkSize()
+	meta := Metadata{
+		Filename:   "message.txt",
+		Size:       int64(len(text)),
+		Chunks:     (len(text) + chunkSize - 1) / chunkSize,
+		Checksum:   crypto.ComputeChecksum([]byte(text)),
+		MimeType:   TextMimeType,
 		BatchIndex: 0,
 		BatchTotal: 1,
+		Text:       true,
+	}
+	stats, err := s.sendContent(ctx, strings.NewReader(text), meta, progressFn)
+	s.config.finish(err)
+	return stats, err
+}
+
+// sendContent sends one file, resuming or restarting it when either side
+// reconnects. The checksum is computed first if meta has none.
+func (s *Sender) sendContent(ctx context.Context, content io.ReadSeeker, meta Metadata, progressFn func(sent, total int64)) (stats Stats, err error) {
+	s.config.emit(FileStartEvent{Index: meta.BatchIndex, Metadata: meta})
+	defer func() {
+		s.config.emit(FileEndEvent{Index: meta.BatchIndex, Metadata: meta, Stats: stats, Err: err})
+	}()
+
+	// Compute checksum, unless the manifest already needed it
+	if meta.Checksum == "" {
+		s.config.emit(PhaseEvent{Phase: PhaseHashing})
+		s.debug("Computing checksum for %s", meta.RelPath())
+		checksum, err := crypto.ComputeChecksumReader(content)
+		if err != nil {
+			return stats, fmt.Errorf("failed to read file for checksum: %w", err)
+		}
+		meta.Checksum = checksum
+	}
+	s.debug("Checksum: %s", meta.Checksum)
+
+	startTime := time.Now()
+	progressFn = s.config.metered(meta.BatchIndex, progressFn)
+
+	var offset, bytesSent int64
+	for attempt := 0; ; attempt++ {
+		n, verified, err := s.streamFile(ctx, content, meta, offset, progressFn)
+		bytesSent += n
+		if err == nil {
+			stats.Verified = verified
+			stats.Reused = s.reused
+			break
+		}
+		// The signature belonged to the first attempt, continue in full
+		meta.Delta = false
+		var ce *connError
+		switch {
+		case attempt >= s.config.Retries:
+			return stats, err
+		case errors.Is(err, errPeerRejoined):
+			s.debug("Receiver reconnected mid-transfer (%d/%d)", attempt+1, s.config.Retries)
+			s.config.emit(RetryEvent{Attempt: attempt + 1, Max: s.config.Retries, Err: err})
+			offset = s.resumeOffset(meta)
+		case errors.As(err, &ce):
+			s.debug("Connection lost mid-transfer, reconnecting (%d/%d): %v", attempt+1, s.config.Retries, err)
+			s.config.emit(RetryEvent{Attempt: attempt + 1, Max: s.config.Retries, Err: err})
+			s.config.emit(PhaseEvent{Phase: PhaseReconnecting})
+			offset, err = s.reconnect(ctx, meta)
+			if err != nil {
+				return stats, fmt.Errorf("failed to resume transfer: %w", err)
+			}
+		default:
+			return stats, err
+		}
+	}
+
+	duration := time.Since(startTime)
+	speed := float64(bytesSent) / duration.Seconds()
+
+	stats.Duration = duration
+	stats.BytesSent = bytesSent
+	stats.Speed = speed
+	stats.Checksum = meta.Checksum
+
+	s.debug("Transfer complete: %d bytes in %v (%.0f bytes/sec)", bytesSent, duration, speed)
+	return stats, nil
+}
+
+// streamFile sends metadata, the chunks from offset onwards and the complete
+// message, then waits for the receiver to confirm the checksum. It returns
+// the number of chunk bytes written to the relay and whether the checksum
+// was confirmed.
+func (s *Sender) streamFile(ctx context.Context, file io.ReadSeeker, meta Metadata, offset int64, progressFn func(sent, total int64)) (int64, bool, error) {
+	if err := s.poll(); err != nil {
+		return 0, false, err
+	}
+	s.progress = Progress{BatchIndex: meta.BatchIndex, BytesSent: offset}
+	s.verified = ""
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, false, fmt.Errorf("failed to seek file: %w", err)
 	}
 
+	meta.Offset = offset
 	metaMsg, err := NewMetadataMessage(meta)
 	if err != nil {
-		return stats, err
+		return 0, false, err
+	}
+	if err := s.send(metaMsg); err != nil {
+		return 0, false, fmt.Errorf("failed to send metadata: %w", err)
 	}
+	s.config.emit(PhaseEvent{Phase: PhaseTransferring})
+
+	comp := s.compressorFor(meta.MimeType)
+	var bytesSent int64
+	position := offset
+	s.reused = 0
 
-	encryptedMeta, err := crypto.EncryptChunk(EncodeMessage(metaMsg), s.key)
+	var sig *delta.Signature
+	if meta.Delta {
+		if sig, err = s.awaitSignature(ctx); err != nil {
+			return 0, false, err
+		}
+	}
+	if sig != nil && len(sig.Blocks) > 0 {
+		bytesSent, position, err = s.sendDelta(ctx, file, *sig, comp, meta, progressFn)
+	} else {
+		if meta.Delta {
+			s.debug("Receiver has no copy of %s, sending it in full", meta.Filename)
+		}
+		bytesSent, position, err = s.sendChunks(ctx, file, comp, position, meta.Size, progressFn)
+	}
 	if err != nil {
-		return stats, fmt.Errorf("failed to encrypt metadata: %w", err)
+		return bytesSent, false, err
 	}
 
-	if err := s.conn.WriteMessage(websocket.BinaryMessage, encryptedMeta); err != nil {
-		return stats, fmt.Errorf("failed to send metadata: %w", err)
+	if err := s.send(NewCompleteMessage()); err != nil {
+		return bytesSent, false, fmt.Errorf("failed to send complete message: %w", err)
 	}
+	verified, err := s.awaitChecksum(ctx, meta.Checksum, position, meta.Size, progressFn)
+	return bytesSent, verified, err
+}
 
-	buf := make([]byte, s.config.ChunkSize)
+// sendChunks sends the rest of file in chunks, starting at position. It
+// returns the number of bytes sent and the position reached.
+func (s *Sender) sendChunks(ctx context.Context, file io.Reader, comp *compressor, position, size int64, progressFn func(sent, total int64)) (int64, int64, error) {
+	buf := make([]byte, s.chunkSize())
 	var bytesSent int64
 
 	for {
-		select {
-		case <-ctx.Done():
-			// Send cancel message
-			cancelMsg := NewCancelMessage("cancelled by sender")
-			if encMsg, err := crypto.EncryptChunk(EncodeMessage(cancelMsg), s.key); err == nil {
-				s.conn.WriteMessage(websocket.BinaryMessage, encMsg)
-			}
-			return stats, ctx.Err()
-		default:
+		if err := s.checkCredit(ctx, position); err != nil {
+			return bytesSent, position, err
 		}
 
 		n, err := file.Read(buf)
 		if err == io.EOF {
-			break
+			return bytesSent, position, nil
 		}
 		if err != nil {
-			return stats, fmt.Errorf("failed to read file: %w", err)
-		}
-
-		chunkMsg := NewChunkMessage(buf[:n])
-		encryptedChunk, err := crypto.EncryptChunk(EncodeMessage(chunkMsg), s.key)
-		if err != nil {
-			return stats, fmt.Errorf("failed to encrypt chunk: %w", err)
+			return bytesSent, position, fmt.Errorf("failed to read file: %w", err)
 		}
 
-		if err := s.conn.WriteMessage(websocket.BinaryMessage, encryptedChunk); err != nil {
-			return stats, fmt.Errorf("failed to send chunk: %w", err)
+		if err := s.send(chunkMessage(comp, buf[:n])); err != nil {
+			return bytesSent, position, fmt.Errorf("failed to send chunk: %w", err)
 		}
 
 		bytesSent += int64(n)
+		position += int64(n)
 		if progressFn != nil {
-			progressFn(bytesSent, fileSize)
+			progressFn(s.delivered(position), size)
 		}
 	}
+}
 
-	completeMsg := NewCompleteMessage()
-	encryptedComplete, err := crypto.EncryptChunk(EncodeMessage(completeMsg), s.key)
-	if err != nil {
-		return stats, fmt.Errorf("failed to encrypt complete message: %w", err)
+// checkCredit waits for room in the receiver's window, telling the receiver
+// when the wait ends because the transfer was cancelled
+func (s *Sender) checkCredit(ctx context.Context, position int64) error {
+	select {
+	case <-ctx.Done():
+		s.send(NewCancelMessage("cancelled by sender"))
+		return ctx.Err()
+	default:
 	}
 
-	if err := s.conn.WriteMessage(websocket.BinaryMessage, encryptedComplete); err != nil {
-		return stats, fmt.Errorf("failed to send complete message: %w", err)
+	if err := s.waitForCredit(ctx, position); err != nil {
+		if ctx.Err() != nil {
+			s.send(NewCancelMessage("cancelled by sender"))
+		}
+		return err
 	}
-
-	duration := time.Since(startTime)
-	speed := float64(bytesSent) / duration.Seconds()
-
-	stats.Duration = duration
-	stats.BytesSent = bytesSent
-	stats.Speed = speed
-
-	s.debug("Transfer complete: %d bytes in %v (%.0f bytes/sec)", bytesSent, duration, speed)
-	return stats, nil
+	return nil
 }
 
 func (s *Sender) Close() error {
 	if s.conn != nil {
-		return s.conn.Close()
+		err := s.conn.Close()
+		s.drainInbox()
+		s.conn = nil
+		return err
 	}
 	return nil
 }
+
+// modTime converts a modification time for the metadata, where zero means
+// unknown
+func modTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,227 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// target is where the chunks of one incoming file are written
+type target interface {
+	io.Writer
+	// Rewind discards everything written so far, for senders that restart a
+	// file after reconnecting
+	Rewind() error
+	// Commit finalizes the file once its checksum has been verified
+	Commit(meta Metadata) error
+	// Abort discards the partial file
+	Abort()
+}
+
+// fileTarget writes to a hidden temporary file next to the destination and
+// only renames it into place once the file is complete, so nobody watching
+// the directory sees a partial file
+type fileTarget struct {
+	file     *os.File
+	path     string
+	tmpPath  string
+	preserve bool     // apply the sender's mode and modification time
+	base     *os.File // earlier version copied from in delta transfers
+	debugLog func(msg string, args ...interface{})
+}
+
+func newFileTarget(path string, preserve bool, debugLog func(msg string, args ...interface{})) (*fileTarget, error) {
+	file, err := createTemp(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	return &fileTarget{file: file, path: path, tmpPath: file.Name(), preserve: preserve, debugLog: debugLog}, nil
+}
+
+// createTemp is os.CreateTemp with the permissions os.Create uses, so the
+// umask applies as it would to any other new file
+func createTemp(dir string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name, err := tempName(dir)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) && i < 10 {
+			continue
+		}
+		return file, err
+	}
+}
+
+// tempName returns a hidden name in dir for an entry that is not in place yet
+func tempName(dir string) (string, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ".pulse-"+hex.EncodeToString(suffix)+".partial"), nil
+}
+
+// createSymlink creates the link under a temporary name and renames it into
+// place, replacing whatever the conflict policy allowed to be replaced
+func createSymlink(target, path string) error {
+	tmpPath, err := tempName(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	if err := os.Symlink(filepath.FromSlash(target), tmpPath); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move symlink into place: %w", err)
+	}
+	return nil
+}
+
+func (t *fileTarget) Write(p []byte) (int, error) {
+	return t.file.Write(p)
+}
+
+func (t *fileTarget) Rewind() error {
+	if err := t.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
+	return nil
+}
+
+func (t *fileTarget) Commit(meta Metadata) error {
+	if meta.Mode != 0 {
+		if err := t.file.Chmod(fileMode(os.FileMode(meta.Mode), t.preserve)); err != nil {
+			t.debugLog("Failed to apply mode %o to %s: %v", meta.Mode, t.path, err)
+		}
+	}
+	if err := t.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := t.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	t.closeBase()
+	if t.preserve && meta.ModTime != 0 {
+		if err := os.Chtimes(t.tmpPath, time.Time{}, time.Unix(0, meta.ModTime)); err != nil {
+			t.debugLog("Failed to apply modification time to %s: %v", t.path, err)
+		}
+	}
+	if err := os.Rename(t.tmpPath, t.path); err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	syncDir(filepath.Dir(t.path), t.debugLog)
+	return nil
+}
+
+// fileMode is the mode of a received file whose sender announced mode. Only
+// Preserve applies it in full, otherwise the file gets the mode of any new
+// file and keeps just the executable bits, both limited by the umask.
+func fileMode(mode os.FileMode, preserve bool) os.FileMode {
+	if preserve {
+		return mode.Perm()
+	}
+	return (0666 | mode&0111) &^ umask()
+}
+
+func (t *fileTarget) Abort() {
+	t.file.Close()
+	t.closeBase()
+	os.Remove(t.tmpPath)
+}
+
+func (t *fileTarget) closeBase() {
+	if t.base != nil {
+		t.base.Close()
+		t.base = nil
+	}
+}
+
+// baseOf returns the earlier version of the file out replaces, if any
+func baseOf(out target) *os.File {
+	if t, ok := out.(*fileTarget); ok {
+		return t.base
+	}
+	return nil
+}
+
+// syncDir makes a rename durable. Not every platform can sync a directory,
+// so failures are only logged.
+func syncDir(dir string, debugLog func(msg string, args ...interface{})) {
+	d, err := os.Open(dir)
+	if err != nil {
+		debugLog("Failed to open %s for sync: %v", dir, err)
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		debugLog("Failed to sync %s: %v", dir, err)
+	}
+}
+
+// streamTarget forwards chunks to a writer such as stdout
+type streamTarget struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *streamTarget) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
+
+func (t *streamTarget) Rewind() error {
+	if t.written {
+		return errors.New("cannot restart a stream that was already written")
+	}
+	return nil
+}
+
+func (t *streamTarget) Commit(meta Metadata) error {
+	return nil
+}
+
+func (t *streamTarget) Abort() {}
+
+// textTarget collects a text message in memory
+type textTarget struct {
+	buf bytes.Buffer
+}
+
+func (t *textTarget) Write(p []byte) (int, error) {
+	if t.buf.Len()+len(p) > MaxTextSize {
+		return 0, fmt.Errorf("text exceeds %d bytes", MaxTextSize)
+	}
+	return t.buf.Write(p)
+}
+
+func (t *textTarget) Rewind() error {
+	t.buf.Reset()
+	return nil
+}
+
+func (t *textTarget) Commit(meta Metadata) error {
+	return nil
+}
+
+func (t *textTarget) Abort() {}
+
+// discardTarget drops the chunks of a file that is skipped, still letting
+// the transfer verify and confirm them
+type discardTarget struct{}
+
+func (discardTarget) Write(p []byte) (int, error) { return len(p), nil }
+func (discardTarget) Rewind() error               { return nil }
+func (discardTarget) Commit(meta Metadata) error  { return nil }
+func (discardTarget) Abort()                      {}
@@ -0,0 +1,149 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFileMode(t *testing.T) {
+	mask := umask()
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		preserve bool
+		want     os.FileMode
+	}{
+		{"plain file", 0644, false, 0666 &^ mask},
+		{"executable", 0755, false, 0777 &^ mask},
+		{"owner executable", 0700, false, (0666 | 0100) &^ mask},
+		{"world writable", 0777, false, 0777 &^ mask},
+		{"setuid", os.ModeSetuid | 0755, false, 0777 &^ mask},
+		{"preserved", 0640, true, 0640},
+		{"preserved world writable", 0777, true, 0777},
+		{"preserved setuid", os.ModeSetuid | 0755, true, 0755},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fileMode(tt.mode, tt.preserve); got != tt.want {
+				t.Errorf("fileMode(%o, %v) = %o, want %o", tt.mode, tt.preserve, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUmaskMatchesNewFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no umask on Windows")
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0777 &^ umask(); info.Mode().Perm() != want {
+		t.Errorf("new file has mode %o, want %o", info.Mode().Perm(), want)
+	}
+}
+
+func TestFileTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // content already at the destination, if any
+		writes   []string
+		rewind   int  // rewind after this many writes, if not 0
+		abort    bool // instead of committing
+		want     string
+		wantFile bool
+	}{
+		{name: "commit", writes: []string{"hello ", "world"}, want: "hello world", wantFile: true},
+		{name: "empty", want: "", wantFile: true},
+		{name: "replace", existing: "old content", writes: []string{"new"}, want: "new", wantFile: true},
+		{name: "rewind", writes: []string{"first try", "second"}, rewind: 1, want: "second", wantFile: true},
+		{name: "abort", writes: []string{"partial"}, abort: true},
+		{name: "abort keeps existing", existing: "old content", writes: []string{"partial"}, abort: true, want: "old content", wantFile: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "file.txt")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out, err := newFileTarget(path, false, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, w := range tt.writes {
+				if tt.rewind != 0 && i == tt.rewind {
+					if err := out.Rewind(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := out.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Nobody sees the file before it is complete
+			if got, err := os.ReadFile(path); tt.existing == "" && err == nil {
+				t.Errorf("destination exists before commit with %q", got)
+			} else if tt.existing != "" && string(got) != tt.existing {
+				t.Errorf("destination changed before commit to %q", got)
+			}
+
+			if tt.abort {
+				out.Abort()
+			} else if err := out.Commit(Metadata{Mode: 0644}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(path)
+			if exists := err == nil; exists != tt.wantFile {
+				t.Fatalf("destination exists = %v, want %v", exists, tt.wantFile)
+			}
+			if string(got) != tt.want {
+				t.Errorf("destination holds %q, want %q", got, tt.want)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Name() != "file.txt" {
+					t.Errorf("%s was left behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestFileTargetPreserve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	out, err := newFileTarget(path, true, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := out.Commit(Metadata{Mode: 0640, ModTime: modTime.UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time is %v, want %v", info.ModTime(), modTime)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Errorf("mode is %o, want 640", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,320 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// testRelay forwards messages between the two clients of each room like the
+// real relay. Once it has forwarded dropAfter messages it drops every
+// connection, once.
+type testRelay struct {
+	mu        sync.Mutex
+	rooms     map[string][]*websocket.Conn
+	writeMu   map[*websocket.Conn]*sync.Mutex
+	forwarded int
+	bytes     int // forwarded, encrypted and framed
+	dropAfter int
+	dropped   bool
+}
+
+func newTestRelay(t *testing.T, dropAfter int) (*testRelay, string) {
+	relay := &testRelay{rooms: make(map[string][]*websocket.Conn), writeMu: make(map[*websocket.Conn]*sync.Mutex), dropAfter: dropAfter}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/{token}", relay.serve)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return relay, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func (relay *testRelay) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	token := r.PathValue("token")
+	relay.mu.Lock()
+	relay.rooms[token] = append(relay.rooms[token], conn)
+	relay.writeMu[conn] = &sync.Mutex{}
+	relay.mu.Unlock()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		relay.forward(token, conn, message)
+	}
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	room := relay.rooms[token]
+	for i, other := range room {
+		if other == conn {
+			relay.rooms[token] = append(room[:i], room[i+1:]...)
+			break
+		}
+	}
+}
+
+func (relay *testRelay) forward(token string, from *websocket.Conn, message []byte) {
+	relay.mu.Lock()
+	relay.forwarded++
+	relay.bytes += len(message)
+	if relay.dropAfter > 0 && relay.forwarded >= relay.dropAfter && !relay.dropped {
+		relay.dropped = true
+		for _, conn := range relay.rooms[token] {
+			conn.Close()
+		}
+		delete(relay.rooms, token)
+		relay.mu.Unlock()
+		return
+	}
+	var to *websocket.Conn
+	for _, other := range relay.rooms[token] {
+		if other != from {
+			to = other
+		}
+	}
+	var writeMu *sync.Mutex
+	if to != nil {
+		writeMu = relay.writeMu[to]
+	}
+	relay.mu.Unlock()
+	if to == nil {
+		return
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	to.WriteMessage(websocket.BinaryMessage, message)
+}
+
+func (relay *testRelay) forwardedBytes() int {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	return relay.bytes
+}
+
+func (relay *testRelay) wasDropped() bool {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	return relay.dropped
+}
+
+// connectPeers joins a sender and a receiver to a room of relayURL and waits
+// until they see each other
+func connectPeers(t *testing.T, relayURL string, senderCfg, receiverCfg Config) (*Sender, *Receiver) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sender := NewSender(relayURL, "room", key, senderCfg)
+	if err := sender.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sender.Close() })
+	receiver := NewReceiverWithConfig(relayURL, "room", key, receiverCfg)
+	if err := receiver.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { receiver.Close() })
+	if err := sender.WaitForReceiver(ctx, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver
+}
+
+func randomBytes(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// randomFile writes size random bytes to a new file in dir
+func randomFile(t *testing.T, dir, name string, size int, seed int64) []byte {
+	t.Helper()
+	data := randomBytes(size, seed)
+	writeFile(t, filepath.Join(dir, name), data)
+	return data
+}
+
+// sendFile sends path while the receiver stores it in destDir, and returns
+// the stats of both sides
+func sendFile(t *testing.T, sender *Sender, receiver *Receiver, path, destDir string) (Stats, string, Stats) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var sent Stats
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sent, sendErr = sender.SendFile(ctx, path, nil)
+	}()
+	received, stats, err := receiver.ReceiveFile(ctx, destDir, nil)
+	<-done
+	if sendErr != nil {
+		t.Fatalf("send: %v", sendErr)
+	}
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	return sent, received, stats
+}
+
+func checkContent(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s has %d bytes that differ from the %d sent", path, len(got), len(want))
+	}
+}
+
+func TestResumeAfterDrop(t *testing.T) {
+	const chunk, chunks = 1024, 40
+	tests := []struct {
+		name      string
+		dropAfter int // messages forwarded before the relay drops both peers
+	}{
+		{"early", 10},
+		{"halfway", 25},
+		{"late", 35},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dest := t.TempDir(), t.TempDir()
+			data := randomFile(t, src, "file.bin", chunk*chunks, 1)
+			relay, relayURL := newTestRelay(t, tt.dropAfter)
+			// A small window keeps the sender close to what was received,
+			// so restarting would send noticeably more than resuming
+			sender, receiver := connectPeers(t, relayURL, Config{ChunkSize: chunk, Retries: 3}, Config{Window: 4 * chunk, Retries: 3})
+
+			sent, path, _ := sendFile(t, sender, receiver, filepath.Join(src, "file.bin"), dest)
+			checkContent(t, path, data)
+			if !relay.wasDropped() {
+				t.Fatal("the relay never dropped the connections")
+			}
+			if !sent.Verified {
+				t.Error("checksum was not confirmed")
+			}
+			if limit := int64(len(data)) * 3 / 2; sent.BytesSent >= limit {
+				t.Errorf("sent %d bytes of a %d byte file, it was not resumed", sent.BytesSent, len(data))
+			}
+		})
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	meta := Metadata{Filename: "file", Size: 1000, Checksum: "abc"}
+	tests := []struct {
+		name   string
+		caps   []string
+		resume *Checkpoint
+		want   int64
+	}{
+		{"checkpoint", []string{CapResume}, &Checkpoint{Checksum: "abc", Offset: 400}, 400},
+		{"complete", []string{CapResume}, &Checkpoint{Checksum: "abc", Offset: 1000}, 1000},
+		{"no checkpoint", []string{CapResume}, nil, 0},
+		{"other file", []string{CapResume}, &Checkpoint{Checksum: "def", Offset: 400}, 0},
+		{"beyond the end", []string{CapResume}, &Checkpoint{Checksum: "abc", Offset: 1001}, 0},
+		{"negative", []string{CapResume}, &Checkpoint{Checksum: "abc", Offset: -1}, 0},
+		{"not negotiated", nil, &Checkpoint{Checksum: "abc", Offset: 400}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Sender{peer: ReadyInfo{Resume: tt.resume}, session: Hello{Capabilities: tt.caps}}
+			if got := s.resumeOffset(meta); got != tt.want {
+				t.Errorf("resumeOffset() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func progressMessage(t *testing.T, index int, bytes int64) inbound {
+	t.Helper()
+	msg, err := NewProgressMessage(Progress{BatchIndex: index, BytesSent: bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inbound{msg: msg}
+}
+
+func TestWaitForCredit(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   int64
+		position int64
+		inbox    []inbound
+		closed   bool // the connection is gone
+		wantErr  string
+		wantAt   int64 // progress the sender knows of afterwards
+	}{
+		{name: "no window", position: 1 << 30},
+		{name: "room in window", window: 100, position: 99},
+		{name: "room after progress", window: 100, position: 150, inbox: []inbound{progressMessage(t, 0, 60)}, wantAt: 60},
+		{name: "several reports", window: 100, position: 150, inbox: []inbound{progressMessage(t, 0, 20), progressMessage(t, 0, 70)}, wantAt: 70},
+		{name: "not enough progress", window: 100, position: 150, inbox: []inbound{progressMessage(t, 0, 50)}, wantErr: "timeout", wantAt: 50},
+		{name: "no progress", window: 100, position: 100, wantErr: "timeout"},
+		{name: "progress of another entry", window: 100, position: 100, inbox: []inbound{progressMessage(t, 1, 100)}, wantErr: "timeout"},
+		{name: "receiver cancels", window: 100, position: 100, inbox: []inbound{{msg: NewCancelMessage("stop")}}, wantErr: "stop"},
+		{name: "connection closed", window: 100, position: 100, closed: true, wantErr: "connection closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inbox := make(chan inbound, len(tt.inbox))
+			for _, in := range tt.inbox {
+				inbox <- in
+			}
+			if tt.closed {
+				close(inbox)
+			}
+			s := &Sender{config: Config{Timeout: 50 * time.Millisecond}, peer: ReadyInfo{Window: tt.window}, inbox: inbox}
+			err := s.waitForCredit(context.Background(), tt.position)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("waitForCredit() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("waitForCredit() = %v, want an error about %q", err, tt.wantErr)
+			}
+			if s.progress.BytesSent != tt.wantAt {
+				t.Errorf("receiver progress is %d, want %d", s.progress.BytesSent, tt.wantAt)
+			}
+		})
+	}
+}
+
+func TestWaitForCreditCancelled(t *testing.T) {
+	s := &Sender{config: Config{Timeout: time.Minute}, peer: ReadyInfo{Window: 100}, inbox: make(chan inbound)}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := s.waitForCredit(ctx, 100); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForCredit() = %v, want %v", err, context.Canceled)
+	}
+}
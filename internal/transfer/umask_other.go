@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package transfer
+
+import "os"
+
+// umask is 0, there is no umask to respect here
+func umask() os.FileMode {
+	return 0
+}
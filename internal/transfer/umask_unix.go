@@ -0,0 +1,57 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package transfer
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	umaskOnce sync.Once
+	umaskBits os.FileMode
+)
+
+// umask returns the umask of the process. It is read on first use, not
+// while the package initializes, since without /proc reading it means
+// setting it for a moment.
+func umask() os.FileMode {
+	umaskOnce.Do(func() {
+		if mask, ok := procUmask(); ok {
+			umaskBits = mask
+			return
+		}
+		mask := unix.Umask(0)
+		unix.Umask(mask)
+		umaskBits = os.FileMode(mask)
+	})
+	return umaskBits
+}
+
+// procUmask reads the umask from /proc/self/status, which Linux has
+// reported since 4.7
+func procUmask() (os.FileMode, bool) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "Umask:")
+		if !ok {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+		if err != nil {
+			return 0, false
+		}
+		return os.FileMode(mask), true
+	}
+	return 0, false
+}
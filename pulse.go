@@ -0,0 +1,110 @@
+// Package pulse sends and receives files over a Pulse relay, end-to-end
+// encrypted, for programs that embed transfers rather than run the pulse
+// command.
+//
+// Both peers share a Session: a room on the relay and the key that seals
+// everything in it. One side creates it with NewSession and hands the other
+// a link, which the phone pages and ParseURL understand:
+//
+//	session, _ := pulse.NewSession()
+//	fmt.Println(session.DownloadURL(pulse.DefaultRelay))
+//	client := pulse.NewClient(session)
+//	defer client.Close()
+//	stats, err := client.Send(ctx, file, pulse.FileInfo{Name: "report.pdf", Size: size})
+//
+// Nothing in this package prints. Debug output goes to WithLogger.
+package pulse
+
+import (
+	"github.com/fromjyce/pulse/internal/transfer"
+)
+
+// DefaultRelay is the public relay
+const DefaultRelay = "wss://pulse.relay.app"
+
+type (
+	// Metadata is what the sender announces about each entry
+	Metadata = transfer.Metadata
+	// Stats describes one transferred entry
+	Stats = transfer.Stats
+	// Entry is one item of a batch: a file, a directory or a symlink
+	Entry = transfer.Entry
+	// ReceivedFile is one entry that arrived, with where it was saved
+	ReceivedFile = transfer.ReceivedFile
+	// ConflictPolicy decides what happens to received entries that
+	// already exist
+	ConflictPolicy = transfer.ConflictPolicy
+)
+
+const (
+	ConflictRename    = transfer.ConflictRename
+	ConflictOverwrite = transfer.ConflictOverwrite
+	ConflictSkip      = transfer.ConflictSkip
+	ConflictAsk       = transfer.ConflictAsk
+)
+
+// Actions recorded in ReceivedFile.Conflict
+const (
+	ActionRenamed     = transfer.ActionRenamed
+	ActionOverwritten = transfer.ActionOverwritten
+	ActionSkipped     = transfer.ActionSkipped
+	ActionIdentical   = transfer.ActionIdentical
+)
+
+// Events passed to an Observer. Switch on the type of the event to tell
+// them apart.
+type (
+	Observer        = transfer.Observer
+	ObserverFunc    = transfer.ObserverFunc
+	Event           = transfer.Event
+	Phase           = transfer.Phase
+	PhaseEvent      = transfer.PhaseEvent
+	PeerJoinedEvent = transfer.PeerJoinedEvent
+	FileStartEvent  = transfer.FileStartEvent
+	ProgressEvent   = transfer.ProgressEvent
+	FileEndEvent    = transfer.FileEndEvent
+	RetryEvent      = transfer.RetryEvent
+	ErrorEvent      = transfer.ErrorEvent
+	RecipientEvent  = transfer.RecipientEvent
+)
+
+const (
+	PhaseConnecting   = transfer.PhaseConnecting
+	PhaseWaiting      = transfer.PhaseWaiting
+	PhaseHashing      = transfer.PhaseHashing
+	PhaseTransferring = transfer.PhaseTransferring
+	PhaseVerifying    = transfer.PhaseVerifying
+	PhaseReconnecting = transfer.PhaseReconnecting
+	PhaseDone         = transfer.PhaseDone
+)
+
+// MaxTextSize is the longest text SendText accepts
+const MaxTextSize = transfer.MaxTextSize
+
+// Errors returned by transfers. Match them with errors.Is and errors.As.
+type (
+	// PeerError is a failure the other side reported, or its decision to
+	// cancel
+	PeerError = transfer.PeerError
+	// ChecksumError means the data that arrived is not what was sent
+	ChecksumError = transfer.ChecksumError
+)
+
+var (
+	// ErrDeclined is returned when the accept callback turns a transfer down
+	ErrDeclined = transfer.ErrDeclined
+	// ErrVersionMismatch is returned when the peers speak different
+	// protocol versions
+	ErrVersionMismatch = transfer.ErrVersionMismatch
+)
+
+// CollectEntries expands files and directories into batch entries for
+// SendEntries. Directories are walked and recreated on the other side.
+func CollectEntries(paths []string) ([]Entry, error) {
+	return transfer.CollectEntries(paths)
+}
+
+// ParseConflictPolicy accepts rename, overwrite, skip or ask
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	return transfer.ParseConflictPolicy(s)
+}
@@ -0,0 +1,83 @@
+package pulse
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/fromjyce/pulse/internal/crypto"
+)
+
+// Session is what the two peers of a transfer share: a room on the relay and
+// the key that encrypts everything sent through it. Only the token reaches
+// the relay.
+type Session struct {
+	Token string
+	Key   []byte
+}
+
+// NewSession creates a session with a random token and key
+func NewSession() (Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Session{}, err
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{Token: hex.EncodeToString(b), Key: key}, nil
+}
+
+// checkKey fails early for keys the cipher would only refuse once the
+// transfer has started
+func (s Session) checkKey() error {
+	if len(s.Key) != crypto.KeySize {
+		return fmt.Errorf("invalid session key: %d bytes instead of %d", len(s.Key), crypto.KeySize)
+	}
+	return nil
+}
+
+// DownloadURL is the link for a phone that receives from this session
+func (s Session) DownloadURL(relay string) string {
+	return s.pageURL(relay, "d")
+}
+
+// UploadURL is the link for a phone that sends to this session
+func (s Session) UploadURL(relay string) string {
+	return s.pageURL(relay, "u")
+}
+
+// pageURL puts the key in the fragment, which browsers never send to the
+// relay
+func (s Session) pageURL(relay, page string) string {
+	httpRelay := strings.Replace(strings.Replace(relay, "wss://", "https://", 1), "ws://", "http://", 1)
+	return fmt.Sprintf("%s/%s/%s#%s", httpRelay, page, s.Token, crypto.KeyToBase64(s.Key))
+}
+
+// ParseURL takes a download or upload link apart into the relay it points
+// at and the session
+func ParseURL(link string) (string, Session, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", Session{}, fmt.Errorf("invalid link: %w", err)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || (parts[len(parts)-2] != "d" && parts[len(parts)-2] != "u") {
+		return "", Session{}, errors.New("invalid link: not a pulse download or upload link")
+	}
+	key, err := crypto.KeyFromBase64(u.Fragment)
+	if err != nil || len(key) != crypto.KeySize {
+		return "", Session{}, errors.New("invalid link: missing or malformed key")
+	}
+
+	scheme := "wss"
+	if u.Scheme == "http" {
+		scheme = "ws"
+	}
+	relay := (&url.URL{Scheme: scheme, Host: u.Host, Path: strings.Join(parts[:len(parts)-2], "/")}).String()
+	return strings.TrimSuffix(relay, "/"), Session{Token: parts[len(parts)-1], Key: key}, nil
+}
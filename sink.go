@@ -0,0 +1,72 @@
+package pulse
+
+import (
+	"context"
+	"io"
+
+	"github.com/fromjyce/pulse/internal/transfer"
+)
+
+// Sink is where Receive puts what arrives: see ToDir, ToWriter and ToText
+type Sink interface {
+	receive(ctx context.Context, r *transfer.Receiver, progressFn func(index int, received, total int64)) ([]ReceivedFile, error)
+}
+
+// ToDir saves every entry of a batch below dir, applying the conflict
+// policy to entries that already exist. Files are only moved into place
+// once their checksum has been verified.
+func ToDir(dir string) Sink {
+	return dirSink(dir)
+}
+
+// ToWriter writes a single file to w as it arrives, such as to stdout
+func ToWriter(w io.Writer) Sink {
+	return writerSink{w}
+}
+
+// ToText accepts only a text message, at most MaxTextSize bytes, and writes
+// it to w once it is complete and verified
+func ToText(w io.Writer) Sink {
+	return textSink{w}
+}
+
+type dirSink string
+
+func (s dirSink) receive(ctx context.Context, r *transfer.Receiver, progressFn func(index int, received, total int64)) ([]ReceivedFile, error) {
+	return r.ReceiveBatch(ctx, string(s), progressFn)
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) receive(ctx context.Context, r *transfer.Receiver, progressFn func(index int, received, total int64)) ([]ReceivedFile, error) {
+	meta, stats, err := r.ReceiveStream(ctx, s.w, single(progressFn))
+	if err != nil {
+		return nil, err
+	}
+	return []ReceivedFile{{Metadata: meta, Stats: stats}}, nil
+}
+
+type textSink struct {
+	w io.Writer
+}
+
+func (s textSink) receive(ctx context.Context, r *transfer.Receiver, progressFn func(index int, received, total int64)) ([]ReceivedFile, error) {
+	text, meta, stats, err := r.ReceiveText(ctx, single(progressFn))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(s.w, text); err != nil {
+		return nil, err
+	}
+	return []ReceivedFile{{Metadata: meta, Stats: stats}}, nil
+}
+
+// single adapts a batch progress callback to one entry
+func single(progressFn func(index int, received, total int64)) func(received, total int64) {
+	if progressFn == nil {
+		return nil
+	}
+	return func(received, total int64) { progressFn(0, received, total) }
+}